@@ -1,12 +1,57 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
+// Categories of differences found by an audit
+var auditOnDiskNotInMetadata = "on_disk_not_in_metadata"
+var auditNeedsDownload = "needs_download"
+var auditDeletedFromFlickr = "deleted_from_flickr"
+var auditUntrackedFile = "untracked_file"
+var auditMissingFile = "missing_file"
+
+// The results of every set audited during this run
+var auditReport = []SetAudit{}
+
+// What audit -fix did about a discrepancy
+var fixAdopted = "adopted"
+var fixDroppedMetadata = "dropped_metadata"
+var fixDownloaded = "downloaded"
+var fixTrashed = "trashed"
+
+type SetAudit struct {
+	SetId         string             `json:"setId"`
+	Title         string             `json:"title"`
+	Directory     string             `json:"directory"`
+	Discrepancies []AuditDiscrepancy `json:"discrepancies"`
+	Fixes         []AuditFix         `json:"fixes,omitempty"`
+}
+
+type AuditFix struct {
+	Action   string `json:"action"`
+	MediaId  string `json:"mediaId,omitempty"`
+	FileName string `json:"fileName"`
+	Error    string `json:"error,omitempty"`
+}
+
+type AuditDiscrepancy struct {
+	Category string `json:"category"`
+	MediaId  string `json:"mediaId,omitempty"`
+	Title    string `json:"title,omitempty"`
+	FileName string `json:"fileName,omitempty"`
+}
+
+func (sa *SetAudit) add(category string, mediaId string, title string, fileName string) {
+
+	sa.Discrepancies = append(sa.Discrepancies, AuditDiscrepancy{Category: category, MediaId: mediaId, Title: title, FileName: fileName})
+}
+
 /**
  *
  * Loop through the photos in the set. See if each media exists in the metadata. Keep track of photos
@@ -16,9 +61,11 @@ import (
  *
  **/
 
-func auditSet(existingFiles []os.FileInfo, metadata *SetMetadata, photos map[string]Photo, set Photoset, metadataFile string, setDir string) {
+func auditSet(existingFiles []os.FileInfo, metadata *SetMetadata, photos map[string]Photo, set Photoset, metadataFile string, setDir string) SetAudit {
+
+	logInfo(fmt.Sprintf("Auditing set: `%v'", set.Title), "setId", set.Id)
 
-	logMessage(fmt.Sprintf("Auditing set: `%v'", set.Title), true)
+	result := SetAudit{SetId: set.Id, Title: set.Title, Directory: setDir, Discrepancies: []AuditDiscrepancy{}}
 
 	// Convert the metadata into a map for ease of use
 	photoIdMap := map[string]MediaMetadata{}
@@ -37,15 +84,17 @@ func auditSet(existingFiles []os.FileInfo, metadata *SetMetadata, photos map[str
 
 			doLog := true
 			for _, fi := range existingFiles {
-				if strings.Index(fi.Name(), mediaId) == 0 {
-					logMessage(fmt.Sprintf("Media Id `%v' (%v) does not exist in the metadata, but the media appears to exist on disk with file name `%v'. It needs to be added to the metadata.", mediaId, photo.Title, fi.Name()), true)
+				if strings.Index(unsequencedFileName(fi.Name()), mediaId) == 0 {
+					logWarn(fmt.Sprintf("Media Id `%v' (%v) does not exist in the metadata, but the media appears to exist on disk with file name `%v'. It needs to be added to the metadata.", mediaId, photo.Title, fi.Name()), "setId", set.Id, "photoId", mediaId)
+					result.add(auditOnDiskNotInMetadata, mediaId, photo.Title, fi.Name())
 					doLog = false
 					break
 				}
 			}
 
 			if doLog {
-				logMessage(fmt.Sprintf("Media Id `%v' (%v) does not exist in the metadata. It needs to be downloaded and added to the metadata.", mediaId, photo.Title), true)
+				logWarn(fmt.Sprintf("Media Id `%v' (%v) does not exist in the metadata. It needs to be downloaded and added to the metadata.", mediaId, photo.Title), "setId", set.Id, "photoId", mediaId)
+				result.add(auditNeedsDownload, mediaId, photo.Title, "")
 			}
 		}
 	}
@@ -54,23 +103,22 @@ func auditSet(existingFiles []os.FileInfo, metadata *SetMetadata, photos map[str
 	for photoId, pm := range photoIdMap {
 
 		if _, ok := photos[photoId]; !ok {
-			logMessage(fmt.Sprintf("Media Id `%v' (%v) does not exist in Flickr and needs to be deleted.", photoId, pm.Title), true)
+			logWarn(fmt.Sprintf("Media Id `%v' (%v) does not exist in Flickr and needs to be deleted.", photoId, pm.Title), "setId", set.Id, "photoId", photoId)
+			result.add(auditDeletedFromFlickr, photoId, pm.Title, pm.Filename)
 		}
 	}
 
-	// Find photos on disk that are not in the metadata
+	// Find media on disk that is not in the metadata
 	for _, fi := range existingFiles {
-		if fi.Name() == setMetadataFileName {
-			continue
-		}
 		_, valueExists := fileNameMap[fi.Name()]
 		if valueExists == false {
-			logMessage(fmt.Sprintf("Media exists on disk, but not in metadata. This is a bug.: `%v'.", fi.Name()), true)
+			logWarn(fmt.Sprintf("Media exists on disk, but not in metadata. This is a bug.: `%v'.", fi.Name()), "setId", set.Id)
+			result.add(auditUntrackedFile, "", "", fi.Name())
 		}
 	}
 
 	// Find photos in metadata that are not on disk
-	for fileName, _ := range fileNameMap {
+	for fileName, pm := range fileNameMap {
 		if fileName == setMetadataFileName {
 			continue
 		}
@@ -78,7 +126,175 @@ func auditSet(existingFiles []os.FileInfo, metadata *SetMetadata, photos map[str
 		// make the full file path from the filename
 		fullFileName := filepath.Join(setDir, fileName)
 		if !pathExists(fullFileName) {
-			logMessage(fmt.Sprintf("File exists in metadata, but not on disk. The file was either deleted or never saved correctly. This is a bug.: `%v'.", fullFileName), true)
+			logWarn(fmt.Sprintf("File exists in metadata, but not on disk. The file was either deleted or never saved correctly. This is a bug.: `%v'.", fullFileName), "setId", set.Id, "photoId", pm.PhotoId)
+			result.add(auditMissingFile, pm.PhotoId, pm.Title, fileName)
+		}
+	}
+
+	return result
+}
+
+/**
+ * Repairs the discrepancies found by auditSet:
+ *  - media on disk that isn't in the metadata is adopted into the metadata
+ *  - metadata entries whose file is gone are dropped, and downloaded again if
+ *    the media is still on Flickr
+ *  - media deleted from Flickr is moved to the trash and dropped from the metadata
+ *  - any other media file on disk that isn't in the metadata is moved to the trash
+ *  - media that was never downloaded is downloaded
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context    Cancels the downloads
+ * @param   FlickrOAuth        Flickr OAuth config
+ * @param   *SetAudit          The audit of the set, fixes are added to it
+ * @param   *SetMetadata       The set's metadata
+ * @param   map[string]Photo   The set's media on Flickr
+ * @param   string             The metadata filename
+ * @param   string             The set's directory
+ * @return  void
+**/
+
+func repairSet(ctx context.Context, appFlickrOAuth FlickrOAuth, setAudit *SetAudit, metadata *SetMetadata, photos map[string]Photo, metadataFile string, setDir string) {
+
+	addFix := func(action string, mediaId string, fileName string, err error) {
+		fix := AuditFix{Action: action, MediaId: mediaId, FileName: fileName}
+		if err != nil {
+			fix.Error = err.Error()
+		}
+		setAudit.Fixes = append(setAudit.Fixes, fix)
+	}
+
+	adopted := map[string]bool{}
+	toDownload := []string{}
+
+	for _, d := range setAudit.Discrepancies {
+		if d.Category == auditOnDiskNotInMetadata {
+			metadata.AddOrUpdate(MediaMetadata{PhotoId: d.MediaId, Title: d.Title, Filename: d.FileName}, metadataFile)
+			adopted[d.FileName] = true
+			addFix(fixAdopted, d.MediaId, d.FileName, nil)
+			logInfo(fmt.Sprintf("Adopted `%v' into the metadata as media Id `%v'.", d.FileName, d.MediaId), "setId", setAudit.SetId, "photoId", d.MediaId)
+		}
+	}
+
+	for _, d := range setAudit.Discrepancies {
+
+		switch d.Category {
+
+		case auditMissingFile:
+			// Media deleted from Flickr is dropped as deleted_from_flickr
+			if _, ok := photos[d.MediaId]; !ok {
+				continue
+			}
+			metadata.RemoveItemByFilename(d.FileName, metadataFile)
+			addFix(fixDroppedMetadata, d.MediaId, d.FileName, nil)
+			toDownload = append(toDownload, d.MediaId)
+
+		case auditDeletedFromFlickr:
+			fullPath := filepath.Join(setDir, d.FileName)
+			if pathExists(fullPath) {
+				_, err := trashFile(fullPath)
+				addFix(fixTrashed, d.MediaId, d.FileName, err)
+				if err != nil {
+					logError(fmt.Sprintf("Could not move `%v' to the trash: %v", fullPath, err), "setId", setAudit.SetId, "photoId", d.MediaId)
+					continue
+				}
+			}
+			if pathExists(fullPath + xmpSidecarSuffix) {
+				trashFile(fullPath + xmpSidecarSuffix)
+			}
+			metadata.RemoveItemById(d.MediaId, metadataFile)
+			addFix(fixDroppedMetadata, d.MediaId, d.FileName, nil)
+
+		case auditUntrackedFile:
+			if adopted[d.FileName] {
+				continue
+			}
+			fullPath := filepath.Join(setDir, d.FileName)
+			trashPath, err := trashFile(fullPath)
+			addFix(fixTrashed, "", d.FileName, err)
+			if err != nil {
+				logError(fmt.Sprintf("Could not move `%v' to the trash: %v", fullPath, err), "setId", setAudit.SetId)
+			} else {
+				logInfo(fmt.Sprintf("Moved `%v' to the trash at `%v'.", fullPath, trashPath), "setId", setAudit.SetId)
+				if pathExists(fullPath + xmpSidecarSuffix) {
+					trashFile(fullPath + xmpSidecarSuffix)
+				}
+			}
+
+		case auditNeedsDownload:
+			toDownload = append(toDownload, d.MediaId)
+		}
+	}
+
+	for _, mediaId := range toDownload {
+		if ctx.Err() != nil {
+			return
+		}
+		if downloadMedia(ctx, appFlickrOAuth, photos[mediaId], setDir, metadata, metadataFile) {
+			addFix(fixDownloaded, mediaId, fileNameForMediaId(metadata, mediaId), nil)
+		} else {
+			addFix(fixDownloaded, mediaId, "", errors.New("could not download the media"))
+		}
+	}
+}
+
+func fileNameForMediaId(metadata *SetMetadata, mediaId string) string {
+
+	for _, pm := range metadata.Photos {
+		if pm.PhotoId == mediaId {
+			return pm.Filename
+		}
+	}
+
+	return ""
+}
+
+/**
+ * Prints a summary of everything audit -fix did
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  void
+**/
+
+func printRepairSummary() {
+
+	fixed := map[string]int{}
+	failed := 0
+	for _, setAudit := range auditReport {
+		for _, fix := range setAudit.Fixes {
+			if fix.Error != "" {
+				failed++
+			} else {
+				fixed[fix.Action]++
+			}
 		}
 	}
+
+	printLine(fmt.Sprintf("Fixed: adopted %v files into the metadata, dropped %v metadata entries, downloaded %v files and moved %v files to the trash. %v fixes failed.",
+		fixed[fixAdopted], fixed[fixDroppedMetadata], fixed[fixDownloaded], fixed[fixTrashed], failed))
+}
+
+/**
+ * Prints the audit results of every set as json
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  void
+**/
+
+func printAuditReport() {
+
+	totals := map[string]int{}
+	for _, setAudit := range auditReport {
+		for _, d := range setAudit.Discrepancies {
+			totals[d.Category]++
+		}
+	}
+
+	printJson(struct {
+		Sets   []SetAudit     `json:"sets"`
+		Totals map[string]int `json:"totals"`
+	}{auditReport, totals})
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+type FileChecksum struct {
+	Sha256 string
+	Size   int64
+}
+
+/**
+ * Computes the SHA-256 and size of a file
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string                The full path to the file
+ * @return  FileChecksum, error
+**/
+
+func hashFile(fullPath string) (FileChecksum, error) {
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+
+	return FileChecksum{Sha256: hex.EncodeToString(h.Sum(nil)), Size: size}, nil
+}
+
+/**
+ * Computes the SHA-256 and size of bytes we're about to write
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   []byte         The contents
+ * @return  FileChecksum
+**/
+
+func hashBytes(contents []byte) FileChecksum {
+
+	sum := sha256.Sum256(contents)
+	return FileChecksum{Sha256: hex.EncodeToString(sum[:]), Size: int64(len(contents))}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var mirrorCollections = new(bool)
+
+// Where each set's directory is on disk, indexed by set Id, as of the start of
+// the sync. Sets are found by Id so their directories can be moved.
+var setDirectories map[string]string
+
+/**
+ * Records which collections each set is in, from the user's collection tree.
+ * Flickr lets a set be in more than one collection; the first one in the tree
+ * is used.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context   Cancels the request
+ * @param   FlickrOAuth       The oauth configuration
+ * @param   []Photoset        The sets, updated in place
+ * @return  error
+**/
+
+func assignCollections(ctx context.Context, appFlickrOAuth FlickrOAuth, sets []Photoset) error {
+
+	tree, err := getCollectionTree(ctx, appFlickrOAuth)
+	if err != nil {
+		return err
+	}
+
+	paths := map[string][]string{}
+	var visit func(collections []Collection, parents []string)
+	visit = func(collections []Collection, parents []string) {
+		for _, collection := range collections {
+			path := append(append([]string{}, parents...), cleanFileName(collection.Title))
+			for _, set := range collection.Sets {
+				if _, ok := paths[set.Id]; !ok {
+					paths[set.Id] = path
+				}
+			}
+			visit(collection.Collections, path)
+		}
+	}
+	visit(tree, nil)
+
+	for i := range sets {
+		sets[i].Collections = paths[sets[i].Id]
+	}
+
+	return nil
+}
+
+/**
+ * Finds the directory of every set on disk by the set Id in its metadata
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  map[string]string   The directories, indexed by set Id
+**/
+
+func indexSetDirectories() map[string]string {
+
+	dirs := map[string]string{}
+	for _, dir := range findSetDirectories() {
+		metadata, _ := loadSetMetadata(dir)
+		if _, ok := dirs[metadata.SetId]; !ok {
+			dirs[metadata.SetId] = dir
+		}
+	}
+
+	return dirs
+}
+
+/**
+ * Moves a set's directory to where it belongs now, after the set was moved to
+ * another collection or -collections was turned on or off. A set whose title
+ * changed keeps the directory it has. Directories of collections left empty
+ * are removed.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   Photoset   The set
+ * @param   string     Where the set's directory belongs
+ * @return  string     Where the set's directory is
+**/
+
+func relocateSetDir(set Photoset, dir string) string {
+
+	existing, ok := setDirectories[set.Id]
+	if set.Id == "" || !ok || existing == dir {
+		return dir
+	}
+
+	// Only the collections decide where the directory goes, its name stays
+	dir = filepath.Join(filepath.Dir(dir), filepath.Base(existing))
+	if existing == dir || pathExists(dir) {
+		return dir
+	}
+
+	// Audits only look
+	if auditOnly && !*auditFix {
+		return existing
+	}
+
+	// Never move -dir itself, or anything it is inside of
+	if containsPath(existing, *rootDirectory) {
+		logWarn(fmt.Sprintf("Not moving `%v' to `%v', it contains the root directory.", existing, dir), "setId", set.Id)
+		return dir
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		logWarn(fmt.Sprintf("Could not move `%v' to `%v': %v", existing, dir, err), "setId", set.Id)
+		return existing
+	}
+
+	if err := os.Rename(existing, dir); err != nil {
+		logWarn(fmt.Sprintf("Could not move `%v' to `%v': %v", existing, dir, err), "setId", set.Id)
+		return existing
+	}
+
+	logInfo(fmt.Sprintf("Moved set `%v' from `%v' to `%v'.", set.Title, existing, dir), "setId", set.Id)
+	setDirectories[set.Id] = dir
+
+	// os.Remove only removes empty directories
+	root := filepath.Clean(*rootDirectory)
+	for parent := filepath.Dir(existing); parent != root && len(parent) > len(root); parent = filepath.Dir(parent) {
+		if os.Remove(parent) != nil {
+			break
+		}
+	}
+
+	return dir
+}
+
+func containsPath(parent string, path string) bool {
+
+	absParent, err := filepath.Abs(parent)
+	if err != nil {
+		return true
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return true
+	}
+
+	rel, err := filepath.Rel(absParent, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,760 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Exit codes
+var exitOk = 0
+var exitFailure = 1
+var exitUsage = 2
+var exitLocked = 3
+var exitInterrupted = 130
+
+type Command struct {
+	Name        string
+	Summary     string
+	Description string
+
+	// Offline commands don't talk to Flickr, so they don't need credentials
+	Offline bool
+
+	// Whether the command needs -dir
+	NeedsDir bool
+
+	// Whether the command will change files, so it needs the locks that stop
+	// two fsyncs running at once. Nil for commands that never do.
+	Locks func() bool
+
+	AddFlags func(flags *flag.FlagSet)
+	Run      func(flags *flag.FlagSet) int
+}
+
+// Old style boolean flags, and the commands that replaced them
+var legacyFlags = map[string]string{
+	"audit":     "audit",
+	"count":     "count",
+	"dupes":     "dupes",
+	"genApiSig": "debug-signature",
+}
+
+var commands []*Command
+
+func init() {
+
+	commands = []*Command{
+		&Command{
+			Name:    "sync",
+			Summary: "Download your sets from Flickr and remove media that was deleted from Flickr",
+			Description: "Syncs every set (and the media not in a set) to a directory per set under -dir.\n" +
+				"Sets whose file counts already match Flickr are skipped unless -force is given.",
+			NeedsDir: true,
+			Locks:    always,
+			AddFlags: func(flags *flag.FlagSet) {
+				addSetFlags(flags)
+				addDownloadFlags(flags)
+				addSetLayoutFlags(flags)
+				addProgressFlags(flags)
+				flags.BoolVar(forceProcessing, "force", false, "Force processing of each set; don't skip sets even if file counts match")
+			},
+			Run: runSync,
+		},
+		&Command{
+			Name:    "watch",
+			Summary: "Keep syncing on an interval, until interrupted",
+			Description: "Syncs every -interval. Sets whose update date and counts on Flickr haven't changed since the last\n" +
+				"sync are skipped, and every -fullEvery syncs all of them are looked at. On SIGINT or SIGTERM the\n" +
+				"download in progress is cancelled and fsync exits. The status is written to\n" +
+				"~/.fsync/watch-status.json, and served as json on -statusAddr if given.",
+			NeedsDir: true,
+			Locks:    always,
+			AddFlags: func(flags *flag.FlagSet) {
+				addSetFlags(flags)
+				addDownloadFlags(flags)
+				addSetLayoutFlags(flags)
+				addProgressFlags(flags)
+				flags.BoolVar(forceProcessing, "force", false, "Force processing of each set; don't skip sets even if file counts match")
+				flags.DurationVar(watchInterval, "interval", time.Hour, "How long to wait between syncs")
+				flags.IntVar(watchFullEvery, "fullEvery", 24, "Look at every set, changed or not, once in this many syncs")
+				flags.StringVar(watchStatusAddr, "statusAddr", "", "Serve the status as json on this address, e.g. localhost:8080")
+			},
+			Run: runWatch,
+		},
+		&Command{
+			Name:    "audit",
+			Summary: "Compare the media on disk with the media on Flickr and display the differences",
+			Description: "Audits every set (or just -setId) without downloading or deleting anything.\n" +
+				"With -fix, files on disk are adopted into the metadata, dangling metadata entries are dropped,\n" +
+				"missing media is downloaded and orphaned files are moved to the .trash directory under -dir.",
+			NeedsDir: true,
+			Locks:    func() bool { return *auditFix },
+			AddFlags: func(flags *flag.FlagSet) {
+				addSetFlags(flags)
+				addFormatFlag(flags)
+				addDownloadFlags(flags)
+				addSetLayoutFlags(flags)
+				flags.BoolVar(auditFix, "fix", false, "Repair the differences the audit finds")
+			},
+			Run: runAudit,
+		},
+		&Command{
+			Name:    "count",
+			Summary: "Recursively count all media files in -dir",
+			Description: "Counts the media files on disk by type. Duplicates are included, since media can be in more than one set.\n" +
+				"Media is recognized by file extension, or by its contents for files without a known extension.\n" +
+				"With -remote, the number of media in each set on Flickr is compared with the set's metadata and\n" +
+				"the files on disk instead, and sets that are out of sync are marked. Nothing is downloaded.",
+			Offline:  true,
+			NeedsDir: true,
+			AddFlags: func(flags *flag.FlagSet) {
+				addFormatFlag(flags)
+				flags.BoolVar(countBySet, "bySet", false, "Also print the counts for each set directory")
+				flags.BoolVar(countRemote, "remote", false, "Compare the counts for each set with Flickr")
+			},
+			Run: runCount,
+		},
+		&Command{
+			Name:    "stats",
+			Summary: "Print how much disk the media files in -dir use",
+			Description: "Prints the bytes used in total, by each set, by each media type and by the month media was uploaded to\n" +
+				"Flickr, the largest files, and the bytes used by extra copies of media that is in more than one set.\n" +
+				"Media downloaded before upload dates were stored is counted by its file time until the next sync.",
+			Offline:  true,
+			NeedsDir: true,
+			AddFlags: func(flags *flag.FlagSet) {
+				addFormatFlag(flags)
+				flags.IntVar(statsTop, "top", 10, "How many of the largest files to list")
+			},
+			Run: runStats,
+		},
+		&Command{
+			Name:    "dupes",
+			Summary: "Find and print media files that exist in multiple sets",
+			Description: "Lists the media files that were downloaded into more than one set directory, by file name.\n" +
+				"With -content, files are compared by size and SHA-256 instead, which also finds the same photo\n" +
+				"uploaded to Flickr twice. With -similar, JPEG, PNG and GIF images are compared by perceptual hash,\n" +
+				"which finds re-edited or re-compressed uploads of the same photo. With -link, byte-identical copies\n" +
+				"are replaced with hardlinks (or reflinks) to one copy; use -dryRun to see how much space that reclaims.",
+			Offline:  true,
+			NeedsDir: true,
+			Locks:    func() bool { return *dupesLink && !*dupesDryRun },
+			AddFlags: func(flags *flag.FlagSet) {
+				addFormatFlag(flags)
+				flags.BoolVar(dupesByContent, "content", false, "Find byte-identical files, rather than files with the same name")
+				flags.BoolVar(dupesSimilar, "similar", false, "Find images that look alike, using perceptual hashes")
+				flags.StringVar(similarHashType, "hash", "perceptual", "The perceptual hash for -similar: average, difference or perceptual")
+				flags.IntVar(similarDistance, "distance", 10, "The largest Hamming distance (out of 64 bits) between hashes of similar images")
+				flags.BoolVar(dupesLink, "link", false, "Replace byte-identical copies with hardlinks to a single copy")
+				flags.BoolVar(useReflinks, "reflink", false, "With -link, make copy-on-write reflinks instead of hardlinks (btrfs, xfs)")
+				flags.BoolVar(dupesDryRun, "dryRun", false, "With -link, only report what would be linked and the bytes reclaimed")
+			},
+			Run: runDupes,
+		},
+		&Command{
+			Name:    "verify",
+			Summary: "Rehash the media files and compare them with the checksums stored at download time",
+			Description: "Reports files that are corrupted or missing. With -repair they are downloaded from Flickr again,\n" +
+				"which needs credentials. Files downloaded before checksums were kept are reported as having no\n" +
+				"checksum; -update records their current checksum. Exits with 1 if any problem remains.",
+			Offline:  true,
+			NeedsDir: true,
+			Locks:    func() bool { return *verifyRepair || *verifyUpdate },
+			AddFlags: func(flags *flag.FlagSet) {
+				addFormatFlag(flags)
+				addDownloadFlags(flags)
+				flags.BoolVar(verifyRepair, "repair", false, "Download corrupted or missing files from Flickr again")
+				flags.BoolVar(verifyUpdate, "update", false, "Record the checksum of files that don't have one yet")
+			},
+			Run: runVerify,
+		},
+		&Command{
+			Name:    "fix-times",
+			Summary: "Set the modification times of media already on disk from their Flickr dates",
+			Description: "Sets the time of every media file (and XMP sidecar) in the set metadata from -mtime, and with\n" +
+				"-dirMtime the time of each set directory, without downloading anything. Media synced before Flickr's\n" +
+				"dates were stored has no date until the next sync with -force.",
+			Offline:  true,
+			NeedsDir: true,
+			Locks:    always,
+			AddFlags: func(flags *flag.FlagSet) {
+				addFormatFlag(flags)
+				addTimeFlags(flags)
+			},
+			Run: runFixTimes,
+		},
+		&Command{
+			Name:    "history",
+			Summary: "List recent syncs, or show one with `history <id>'",
+			Description: "Every sync saves a record of what it did in ~/.fsync/runs: the sets processed, skipped and failed,\n" +
+				"the media downloaded and deleted, and any errors. Without an Id the most recent runs are listed.",
+			Offline: true,
+			AddFlags: func(flags *flag.FlagSet) {
+				addFormatFlag(flags)
+				flags.IntVar(historyLimit, "limit", 20, "How many runs to list, or 0 for all of them")
+			},
+			Run: runHistory,
+		},
+		&Command{
+			Name:        "auth",
+			Summary:     "Authorize fsync with your Flickr account",
+			Description: "Runs the OAuth handshake with Flickr if there are no saved credentials, or -reset is given.",
+			AddFlags: func(flags *flag.FlagSet) {
+				flags.BoolVar(resetCredentials, "reset", false, "Authorize again even if credentials already exist")
+			},
+			Run: runAuth,
+		},
+		&Command{
+			Name:    "debug-signature",
+			Summary: "Print the api signature for a debug_sbs value",
+			Description: "Useful when debugging an invalid signature response from Flickr.\n" +
+				"Paste the 'debug_sbs' value they send back.",
+			AddFlags: func(flags *flag.FlagSet) {
+				flags.StringVar(debugSbs, "debug_sbs", "", "The debug_sbs return parameter from Flickr.")
+			},
+			Run: runDebugSignature,
+		},
+		&Command{
+			Name:    "config",
+			Summary: "Show the effective configuration: fsync config show",
+			Description: "Prints every setting, its effective value and where it came from, with secrets redacted.\n" +
+				"Settings come from flag defaults < the config file < FSYNC_* environment variables < the command line.",
+			Offline:  true,
+			AddFlags: addAllCommandFlags,
+			Run:      runConfig,
+		},
+	}
+}
+
+/**
+ * Parses the command line, dispatches to the subcommand and returns the exit code
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   []string   The command line arguments, without the program name
+ * @return  int        The exit code
+**/
+
+func runCommandLine(args []string) int {
+
+	if len(args) == 0 {
+		printUsage()
+		return exitUsage
+	}
+
+	name := args[0]
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		if len(args) > 1 {
+			if command := findCommand(args[1]); command != nil {
+				newFlagSet(command).Usage()
+				return exitOk
+			}
+		}
+		printUsage()
+		return exitOk
+	}
+
+	if strings.HasPrefix(name, "-") {
+		flagName := strings.TrimLeft(strings.SplitN(name, "=", 2)[0], "-")
+		if replacement, ok := legacyFlags[flagName]; ok {
+			fmt.Fprintf(os.Stderr, "The -%v flag has been replaced by a command, use: fsync %v [flags]\n", flagName, replacement)
+			return exitUsage
+		}
+
+		// Flags without a command keep the old behavior of syncing
+		name = "sync"
+		args = append([]string{name}, args...)
+	}
+
+	command := findCommand(name)
+	if command == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command `%v'.\n\n", name)
+		printUsage()
+		return exitUsage
+	}
+
+	flags := newFlagSet(command)
+	if err := parseArguments(flags, args[1:]); err != nil {
+		return exitUsage
+	}
+
+	if err := applyConfiguration(flags); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if err := validateOutputFormat(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if err := validateLogFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if err := validateProgressFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if err := validateTimeFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if err := validateLicenseFlag(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if command.NeedsDir && *rootDirectory == "" {
+		fmt.Fprintln(os.Stderr, "You must specify a root directory using -dir")
+		return exitUsage
+	}
+
+	Flogger = createLogger()
+
+	if command.Locks != nil && command.Locks() {
+		locks, err := acquireLocks(command.Name)
+		if err != nil {
+			logError(err.Error())
+			if _, held := err.(*lockHeldError); held {
+				return exitLocked
+			}
+			return exitFailure
+		}
+		defer releaseLocks(locks)
+	}
+
+	if !command.Offline {
+		secrets := loadOAuthSecrets()
+		if !secrets.isValid() {
+			logError("Your OAuth secrets file doesn't exist or is invalid. See the log file for more details.")
+			return exitFailure
+		}
+	}
+
+	return command.Run(flags)
+}
+
+/**
+ * Parses flags that may be mixed in with positional arguments,
+ * e.g. `fsync config show -dir /photos'
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   *flag.FlagSet   The flags to parse into
+ * @param   []string        The arguments after the command name
+ * @return  error
+**/
+
+func parseArguments(flags *flag.FlagSet, args []string) error {
+
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	// Leave the positional arguments in flags.Args()
+	return flags.Parse(append([]string{"--"}, positional...))
+}
+
+/**
+ * Creates the flag set for a command, including the flags every command has
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   *Command        The command
+ * @return  *flag.FlagSet
+**/
+
+func newFlagSet(command *Command) *flag.FlagSet {
+
+	flags := flag.NewFlagSet(command.Name, flag.ContinueOnError)
+	addCommonFlags(flags)
+	if command.NeedsDir {
+		flags.StringVar(rootDirectory, "dir", "", "The base directory where your sets/photos will be downloaded.")
+	}
+	if command.Locks != nil {
+		flags.DurationVar(lockWait, "wait", 0, "If another fsync is changing -dir, wait this long for it to finish instead of exiting")
+	}
+	if command.AddFlags != nil {
+		command.AddFlags(flags)
+	}
+
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "Usage: fsync %v [flags]\n\n%v\n\n%v\n\nFlags:\n", command.Name, command.Summary, command.Description)
+		flags.PrintDefaults()
+	}
+
+	return flags
+}
+
+func addCommonFlags(flags *flag.FlagSet) {
+
+	flags.StringVar(configFile, "config", "", "The config file to read settings from. Defaults to ~/.fsync/config.json")
+	flags.BoolVar(encryptCredentials, "encryptCredentials", false, "Store the OAuth token secret and consumer secret encrypted. The passphrase is read from FSYNC_PASSPHRASE, or prompted for.")
+	flags.BoolVar(verbose, "v", false, "Verbose: also print debug messages, with their fields, to the console")
+	flags.BoolVar(quiet, "q", false, "Quiet: only print warnings and errors to the console")
+	flags.StringVar(logDirectory, "logDir", "", "The directory to write log files to. Defaults to ~/.fsync/logs")
+	flags.StringVar(logFormat, "logFormat", "text", "The log file format: text or json")
+	flags.StringVar(logLevel, "logLevel", "debug", "The lowest level written to the log file: debug, info, warn or error")
+	flags.IntVar(logMaxSize, "logMaxSize", 10, "Start a new log file when the current one reaches this many megabytes")
+	flags.IntVar(logMaxAge, "logMaxAge", 30, "Delete old log files after this many days")
+}
+
+func addSetFlags(flags *flag.FlagSet) {
+
+	flags.StringVar(setId, "setId", "", "Only process a single set")
+	flags.BoolVar(onlyPhotosNotInSet, "onlyNonSet", false, "Skip all sets and only process media that are not in a set")
+	flags.BoolVar(syncFavorites, "favorites", false, "Also sync your favorites, into FAVORITES")
+	flags.BoolVar(syncGalleries, "galleries", false, "Also sync your galleries, into a directory each under GALLERIES")
+	flags.StringVar(syncGroups, "groups", "", "Also sync the pools of these groups (comma separated group NSIDs), into a directory each under GROUPS")
+	flags.StringVar(allowedLicenses, "licenses", "1,2,3,4,5,6,7,8,9,10", "The licenses (comma separated Flickr license Ids) other people's media in favorites, galleries and groups must have to be downloaded. 0 is All Rights Reserved.")
+}
+
+func addFormatFlag(flags *flag.FlagSet) {
+
+	flags.StringVar(outputFormat, "format", "text", "How to print results: text or json")
+}
+
+func addDownloadFlags(flags *flag.FlagSet) {
+
+	flags.BoolVar(decodeImages, "decodeImages", false, "Fully decode downloaded JPEG, PNG and GIF files, and reject any that don't decode")
+	flags.BoolVar(embedMetadata, "embedMetadata", false, "Write the title, description, keywords, date taken, location and license from Flickr into downloaded JPEGs (XMP and IPTC, and EXIF if there is none)")
+	flags.BoolVar(xmpSidecars, "xmp", false, "Write an XMP sidecar next to each media file with its title, description, tags, date taken, location and license from Flickr")
+	addTimeFlags(flags)
+}
+
+func addTimeFlags(flags *flag.FlagSet) {
+
+	flags.StringVar(mediaTimes, "mtime", "none", "Set the modification time of media files from Flickr: none (the download time), taken (the date taken, or the upload date if unknown) or upload")
+	flags.BoolVar(dirTimes, "dirMtime", false, "With -mtime, also set each set directory's modification time to that of its newest media")
+}
+
+func addSetLayoutFlags(flags *flag.FlagSet) {
+
+	flags.BoolVar(sequencePrefix, "sequencePrefix", false, "Prefix file names with their position in the set, e.g. `0007 name.jpg', so they sort the way the set is ordered on Flickr. Files are renamed when the order changes.")
+	flags.BoolVar(mirrorCollections, "collections", false, "Put set directories inside directories for the Flickr collections they are in. Directories are moved when the collections change.")
+	flags.BoolVar(setIndexFiles, "setIndex", false, "Write a README.md into each set directory with the set's title, description and media in order")
+}
+
+func addProgressFlags(flags *flag.FlagSet) {
+
+	flags.StringVar(progressMode, "progress", "auto", "How to show progress: auto (a status line on a terminal, otherwise log lines), plain (log lines) or off")
+	flags.DurationVar(progressInterval, "progressInterval", 30*time.Second, "How often to log progress when it isn't shown as a status line")
+}
+
+/**
+ * Adds the flags of every command to a flag set, so the whole
+ * configuration can be shown at once.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   *flag.FlagSet   The flag set to add to
+ * @return  void
+**/
+
+func addAllCommandFlags(flags *flag.FlagSet) {
+
+	for _, command := range commands {
+
+		if command.Name == "config" {
+			continue
+		}
+
+		newFlagSet(command).VisitAll(func(f *flag.Flag) {
+			if flags.Lookup(f.Name) == nil {
+				flags.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+	}
+}
+
+func always() bool {
+
+	return true
+}
+
+func findCommand(name string) *Command {
+
+	for _, command := range commands {
+		if command.Name == name {
+			return command
+		}
+	}
+
+	return nil
+}
+
+func printUsage() {
+
+	out := os.Stderr
+	fmt.Fprintln(out, "Syncs your flickr photos to your desktop, using your sets to organize the photos.")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Usage: fsync <command> [flags]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Commands:")
+	for _, command := range commands {
+		fmt.Fprintf(out, "  %-17v %v\n", command.Name, command.Summary)
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Run `fsync help <command>' for the flags of a command.")
+}
+
+func runSync(flags *flag.FlagSet) int {
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	err := processSets(ctx, "sync")
+	if ctx.Err() != nil {
+		if err != nil {
+			logWarn(err.Error())
+		}
+		return exitInterrupted
+	}
+
+	if err != nil {
+		logError(err.Error())
+		return exitFailure
+	}
+
+	return exitOk
+}
+
+func runWatch(flags *flag.FlagSet) int {
+
+	if *watchInterval <= 0 || *watchFullEvery <= 0 {
+		fmt.Fprintln(os.Stderr, "-interval and -fullEvery must be greater than zero")
+		return exitUsage
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	if !watch(ctx) {
+		return exitFailure
+	}
+
+	// Stopping between syncs is how watching normally ends
+	if lastRun != nil && lastRun.Status == runInterrupted {
+		return exitInterrupted
+	}
+
+	return exitOk
+}
+
+func runAudit(flags *flag.FlagSet) int {
+
+	auditOnly = true
+	status := runSync(flags)
+	if status != exitOk {
+		return status
+	}
+
+	if isJsonOutput() {
+		printAuditReport()
+	} else if *auditFix {
+		printRepairSummary()
+	}
+
+	return status
+}
+
+func runCount(flags *flag.FlagSet) int {
+
+	// Counting is offline, but comparing with Flickr needs credentials
+	if *countRemote {
+		if !loadOAuthSecrets().isValid() {
+			logError("Your OAuth secrets file doesn't exist or is invalid. See the log file for more details.")
+			return exitFailure
+		}
+
+		if !reconcileCounts() {
+			return exitFailure
+		}
+		return exitOk
+	}
+
+	countFiles()
+	return exitOk
+}
+
+func runStats(flags *flag.FlagSet) int {
+
+	if *statsTop < 0 {
+		fmt.Fprintln(os.Stderr, "-top can't be negative")
+		return exitUsage
+	}
+
+	printStorageStats()
+	return exitOk
+}
+
+func runDupes(flags *flag.FlagSet) int {
+
+	if *dupesSimilar {
+		switch *similarHashType {
+		case "average", "difference", "perceptual":
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown -hash `%v', use average, difference or perceptual\n", *similarHashType)
+			return exitUsage
+		}
+	}
+
+	if *dupesLink {
+		if !linkDuplicates() {
+			return exitFailure
+		}
+		return exitOk
+	}
+
+	findDupes()
+	return exitOk
+}
+
+func runVerify(flags *flag.FlagSet) int {
+
+	// Verifying is offline, but repairing needs to talk to Flickr
+	if *verifyRepair && !loadOAuthSecrets().isValid() {
+		logError("Your OAuth secrets file doesn't exist or is invalid. See the log file for more details.")
+		return exitFailure
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	if !verifyFiles(ctx) {
+		if ctx.Err() != nil {
+			return exitInterrupted
+		}
+		return exitFailure
+	}
+
+	return exitOk
+}
+
+func runFixTimes(flags *flag.FlagSet) int {
+
+	if *mediaTimes == mtimeNone {
+		fmt.Fprintln(os.Stderr, "You must choose the times to set using -mtime taken or -mtime upload")
+		return exitUsage
+	}
+
+	if !fixTimes() {
+		return exitFailure
+	}
+
+	return exitOk
+}
+
+func runHistory(flags *flag.FlagSet) int {
+
+	if *historyLimit < 0 {
+		fmt.Fprintln(os.Stderr, "-limit can't be negative, use 0 to list every run")
+		return exitUsage
+	}
+
+	if !printHistory(flags.Arg(0)) {
+		return exitFailure
+	}
+
+	return exitOk
+}
+
+func runAuth(flags *flag.FlagSet) int {
+
+	if !*resetCredentials {
+		existing := checkForExistingOAuthCredentials()
+		if existing.OAuthToken != "" {
+			logInfo(fmt.Sprintf("Already authorized as user: %v. Use -reset to authorize again.", existing.Username))
+			return exitOk
+		}
+	}
+
+	credentials := doOAuthSetup()
+	if credentials.OAuthToken == "" {
+		logError("Could not get OAuth token setup.")
+		return exitFailure
+	}
+
+	logInfo(fmt.Sprintf("Authorized as user: %v", credentials.Username))
+	return exitOk
+}
+
+func runDebugSignature(flags *flag.FlagSet) int {
+
+	if *debugSbs == "" {
+		fmt.Fprintln(os.Stderr, "You must specify the debug_sbs value using -debug_sbs")
+		return exitUsage
+	}
+
+	signature := getApiSignature(*debugSbs)
+	if len(signature) == 0 {
+		return exitFailure
+	}
+
+	fmt.Println(signature)
+	return exitOk
+}
+
+func runConfig(flags *flag.FlagSet) int {
+
+	if flags.Arg(0) != "show" {
+		fmt.Fprintln(os.Stderr, "Usage: fsync config show [flags]")
+		return exitUsage
+	}
+
+	showConfiguration(flags)
+	return exitOk
+}
+
+/**
+ * Creates a context that is cancelled when fsync gets SIGINT or SIGTERM, so
+ * requests in flight are cancelled and the command can clean up and stop. A
+ * second signal kills fsync straight away.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  context.Context, context.CancelFunc   The context, and the function to call when the command is done
+**/
+
+func interruptContext() (context.Context, context.CancelFunc) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-signals:
+			signal.Stop(signals)
+			logWarn("Interrupted, stopping. Interrupt again to quit now.")
+			cancel()
+		case <-ctx.Done():
+			signal.Stop(signals)
+		}
+	}()
+
+	return ctx, cancel
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var configFileName = "config.json"
+var configFileEnvVar = "FSYNC_CONFIG"
+var envVarPrefix = "FSYNC_"
+
+// Where each effective setting came from, indexed by flag or secret name
+var configSources = map[string]string{}
+var loadedConfigFile = ""
+var unusedConfigKeys = []string{}
+
+// Secrets that can be supplied by the config file or the environment
+// instead of ~/.fsync/oauth-secrets.json and ~/.fsync/oauth.json
+type SecretSetting struct {
+	Name   string
+	EnvVar string
+	Value  string
+}
+
+var configSecrets = []*SecretSetting{
+	&SecretSetting{Name: "consumerKey", EnvVar: "FSYNC_CONSUMER_KEY"},
+	&SecretSetting{Name: "consumerSecret", EnvVar: "FSYNC_CONSUMER_SECRET"},
+	&SecretSetting{Name: "minitokenUrl", EnvVar: "FSYNC_MINITOKEN_URL"},
+	&SecretSetting{Name: "oauthToken", EnvVar: "FSYNC_OAUTH_TOKEN"},
+	&SecretSetting{Name: "oauthTokenSecret", EnvVar: "FSYNC_OAUTH_TOKEN_SECRET"},
+}
+
+/**
+ * Applies the layered configuration to a set of flags. The order of
+ * precedence, lowest first, is: flag defaults, the config file,
+ * FSYNC_* environment variables and finally the command line.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   *flag.FlagSet   The parsed flags
+ * @return  error
+**/
+
+func applyConfiguration(flags *flag.FlagSet) error {
+
+	fromCommandLine := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		fromCommandLine[f.Name] = true
+	})
+
+	fileValues, err := loadConfigFile(flags)
+	if err != nil {
+		return err
+	}
+
+	var setErr error
+	flags.VisitAll(func(f *flag.Flag) {
+
+		if setErr != nil {
+			return
+		}
+
+		if fromCommandLine[f.Name] {
+			configSources[f.Name] = "command line"
+			return
+		}
+
+		// An empty variable counts as unset, the same as for the secrets, so
+		// FSYNC_FORCE= doesn't fail to parse as a bool
+		envVar := envVarForSetting(f.Name)
+		if value, ok := os.LookupEnv(envVar); ok && value != "" {
+			if err := flags.Set(f.Name, value); err != nil {
+				setErr = fmt.Errorf("invalid value for %v: %v", envVar, err)
+				return
+			}
+			configSources[f.Name] = "environment (" + envVar + ")"
+			return
+		}
+
+		if value, ok := fileValues[f.Name]; ok {
+			if err := flags.Set(f.Name, value); err != nil {
+				setErr = fmt.Errorf("invalid value for `%v' in %v: %v", f.Name, loadedConfigFile, err)
+				return
+			}
+			configSources[f.Name] = "config file"
+			delete(fileValues, f.Name)
+			return
+		}
+
+		configSources[f.Name] = "default"
+	})
+
+	if setErr != nil {
+		return setErr
+	}
+
+	for _, secret := range configSecrets {
+
+		if value, ok := os.LookupEnv(secret.EnvVar); ok && value != "" {
+			secret.Value = value
+			configSources[secret.Name] = "environment (" + secret.EnvVar + ")"
+		} else if value, ok := fileValues[secret.Name]; ok && value != "" {
+			secret.Value = value
+			configSources[secret.Name] = "config file"
+		}
+
+		delete(fileValues, secret.Name)
+	}
+
+	for key := range fileValues {
+		unusedConfigKeys = append(unusedConfigKeys, key)
+	}
+	sort.Strings(unusedConfigKeys)
+
+	return nil
+}
+
+/**
+ * Reads the config file, if there is one. The file is a json object whose
+ * keys are flag names or secret names.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   *flag.FlagSet              The parsed flags, to find -config
+ * @return  map[string]string, error   The values indexed by setting name
+**/
+
+func loadConfigFile(flags *flag.FlagSet) (map[string]string, error) {
+
+	values := map[string]string{}
+
+	filePath := ""
+	explicit := true
+	if f := flags.Lookup("config"); f != nil && f.Value.String() != "" {
+		filePath = f.Value.String()
+	} else if env := os.Getenv(configFileEnvVar); env != "" {
+		filePath = env
+	} else {
+		filePath = getUserFilePath(configFileName)
+		explicit = false
+	}
+
+	if !pathExists(filePath) {
+		if explicit {
+			return values, fmt.Errorf("config file `%v' does not exist", filePath)
+		}
+		return values, nil
+	}
+
+	fileContents, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return values, err
+	}
+
+	raw := map[string]interface{}{}
+	if len(fileContents) > 0 {
+		// Numbers are kept as written, or 1000000 would become 1e+06
+		decoder := json.NewDecoder(bytes.NewReader(fileContents))
+		decoder.UseNumber()
+		err = decoder.Decode(&raw)
+		if _, trailing := decoder.Token(); err == nil && trailing != io.EOF {
+			err = errors.New("unexpected data after the settings")
+		}
+		if err != nil {
+			return values, fmt.Errorf("could not parse config file `%v': %v", filePath, err)
+		}
+	}
+
+	// A null is the same as leaving the key out, rather than the string "<nil>"
+	for key, value := range raw {
+		if value != nil {
+			values[key] = fmt.Sprint(value)
+		}
+	}
+
+	loadedConfigFile = filePath
+	return values, nil
+}
+
+/**
+ * Gets the environment variable name for a setting, e.g. setId => FSYNC_SET_ID
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string   The flag name
+ * @return  string   The environment variable name
+**/
+
+func envVarForSetting(name string) string {
+
+	var b strings.Builder
+	b.WriteString(envVarPrefix)
+	for i, r := range name {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteRune('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+
+	return b.String()
+}
+
+/**
+ * Gets a secret supplied by the config file or environment
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string   The secret name
+ * @return  string   The value, or an empty string if it wasn't configured
+**/
+
+func configuredSecret(name string) string {
+
+	for _, secret := range configSecrets {
+		if secret.Name == name {
+			return secret.Value
+		}
+	}
+
+	return ""
+}
+
+/**
+ * Prints the effective configuration, with secrets redacted
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   *flag.FlagSet   The flags to show
+ * @return  void
+**/
+
+func showConfiguration(flags *flag.FlagSet) {
+
+	if loadedConfigFile != "" {
+		fmt.Printf("Config file: %v\n\n", loadedConfigFile)
+	} else {
+		fmt.Printf("Config file: none (looked for %v)\n\n", getUserFilePath(configFileName))
+	}
+
+	flags.VisitAll(func(f *flag.Flag) {
+		fmt.Printf("%-20v = %-30v [%v]\n", f.Name, fmt.Sprintf("%q", f.Value.String()), configSources[f.Name])
+	})
+
+	fmt.Println()
+
+	// Read the files directly rather than loading the secrets, so we never need
+	// the passphrase just to show what is configured
+	secrets := OAuthSecrets{}
+	credentials := FlickrOAuth{}
+	readJsonFile(getUserFilePath(oauthSecretsFile), &secrets)
+	readJsonFile(getUserFilePath(cacheFile), &credentials)
+	storedSecrets := map[string]string{
+		"consumerKey":      secrets.ConsumerKey,
+		"consumerSecret":   secrets.Secret,
+		"minitokenUrl":     secrets.MinitokenUrl,
+		"oauthToken":       credentials.OAuthToken,
+		"oauthTokenSecret": credentials.OAuthTokenSecret,
+	}
+	storedIn := map[string]string{
+		"consumerKey":      oauthSecretsFile,
+		"consumerSecret":   oauthSecretsFile,
+		"minitokenUrl":     oauthSecretsFile,
+		"oauthToken":       cacheFile,
+		"oauthTokenSecret": cacheFile,
+	}
+
+	for _, secret := range configSecrets {
+
+		value := secret.Value
+		source := configSources[secret.Name]
+		if value == "" {
+			value = storedSecrets[secret.Name]
+			source = "~/.fsync/" + storedIn[secret.Name]
+		}
+
+		if value == "" {
+			fmt.Printf("%-20v = %v\n", secret.Name, "(not set)")
+			continue
+		}
+
+		redacted := "(redacted)"
+		if isEncryptedValue(value) {
+			redacted = "(redacted, encrypted)"
+		}
+
+		fmt.Printf("%-20v = %-30v [%v]\n", secret.Name, redacted, source)
+	}
+
+	if len(unusedConfigKeys) > 0 {
+		fmt.Printf("\nUnused keys in the config file: %v\n", strings.Join(unusedConfigKeys, ", "))
+	}
+}
@@ -1,11 +1,45 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
+var countBySet = new(bool)
+var countRemote = new(bool)
+
+type MediaCounts struct {
+	Total       int              `json:"total"`
+	Photos      int              `json:"photos"`
+	Videos      int              `json:"videos"`
+	ByType      map[string]int   `json:"byType"`
+	ByExtension map[string]int   `json:"byExtension"`
+	BySet       []SetMediaCounts `json:"bySet"`
+}
+
+type SetMediaCounts struct {
+	Directory string         `json:"directory"`
+	Total     int            `json:"total"`
+	Photos    int            `json:"photos"`
+	Videos    int            `json:"videos"`
+	ByType    map[string]int `json:"byType"`
+}
+
+// How one set's media counts compare between Flickr, the metadata and the disk
+type SetReconciliation struct {
+	SetId     string `json:"setId"`
+	Title     string `json:"title"`
+	Directory string `json:"directory"`
+	Flickr    int    `json:"flickr"`
+	Metadata  int    `json:"metadata"`
+	Disk      int    `json:"disk"`
+	InSync    bool   `json:"inSync"`
+}
+
 /**
  * Echos the number of media files to the console
  *
@@ -16,8 +50,22 @@ import (
 
 func countFiles() {
 
-	photoCount, movieCount := countMediaFiles()
-	logMessage(fmt.Sprintf("Found %v media files, including duplicates (photos can be part of more than one album). (%v photos, %v movies)", (photoCount+movieCount), photoCount, movieCount), true)
+	counts := countMediaFiles()
+	if isJsonOutput() {
+		printJson(counts)
+		return
+	}
+
+	printLine(fmt.Sprintf("Found %v media files, including duplicates (photos can be part of more than one album). (%v photos, %v movies)", counts.Total, counts.Photos, counts.Videos))
+	if counts.Total > 0 {
+		printLine("By type: " + formatTypeCounts(counts.ByType))
+	}
+
+	if *countBySet {
+		for _, set := range counts.BySet {
+			printLine(fmt.Sprintf("%v: %v media files (%v photos, %v movies). %v", set.Directory, set.Total, set.Photos, set.Videos, formatTypeCounts(set.ByType)))
+		}
+	}
 }
 
 /**
@@ -25,42 +73,186 @@ func countFiles() {
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
- * @return  int,int   The number of photos and the number of videos
+ * @return  MediaCounts   The number of photos and videos, and the counts per media type, file extension and set
 **/
 
-func countMediaFiles() (int, int) {
+func countMediaFiles() MediaCounts {
 
-	var photoCount = 0
-	var movieCount = 0
-	visitor := func(path string, f os.FileInfo, err error) error {
+	counts := MediaCounts{ByType: map[string]int{}, ByExtension: map[string]int{}, BySet: []SetMediaCounts{}}
+	sets := map[string]*SetMediaCounts{}
 
-		if !f.IsDir() {
-			return nil
+	walkMediaFiles(func(path string, f os.FileInfo, mediaType *MediaType) {
+
+		dir, err := filepath.Rel(*rootDirectory, filepath.Dir(path))
+		if err != nil {
+			dir = filepath.Dir(path)
 		}
 
-		matches, _ := filepath.Glob(filepath.Join(path, "*.jpg"))
-		if matches != nil {
-			photoCount += len(matches)
+		set, ok := sets[dir]
+		if !ok {
+			set = &SetMediaCounts{Directory: dir, ByType: map[string]int{}}
+			sets[dir] = set
 		}
 
-		matches, _ = filepath.Glob(filepath.Join(path, "*.gif"))
-		if matches != nil {
-			photoCount += len(matches)
+		if mediaType.Kind == videoKind {
+			counts.Videos++
+			set.Videos++
+		} else {
+			counts.Photos++
+			set.Photos++
 		}
 
-		matches, _ = filepath.Glob(filepath.Join(path, "*.png"))
-		if matches != nil {
-			photoCount += len(matches)
+		counts.Total++
+		set.Total++
+		counts.ByType[mediaType.Name]++
+		set.ByType[mediaType.Name]++
+		counts.ByExtension[strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))]++
+	})
+
+	for _, set := range sets {
+		counts.BySet = append(counts.BySet, *set)
+	}
+	sort.Slice(counts.BySet, func(i, j int) bool { return counts.BySet[i].Directory < counts.BySet[j].Directory })
+
+	return counts
+}
+
+/**
+ * Formats counts by media type as e.g. "jpeg: 10, mov: 2", most common first
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   map[string]int   The count per media type
+ * @return  string
+**/
+
+func formatTypeCounts(byType map[string]int) string {
+
+	names := []string{}
+	for name := range byType {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if byType[names[i]] != byType[names[j]] {
+			return byType[names[i]] > byType[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	parts := []string{}
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%v: %v", name, byType[name]))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+/**
+ * Compares the number of media in each set on Flickr with the number in the
+ * set's metadata and on disk, and prints a table of them with the sets that
+ * are out of sync marked. Only the set lists are fetched from Flickr, nothing
+ * is downloaded.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  bool   Whether the counts could be fetched from Flickr
+**/
+
+func reconcileCounts() bool {
+
+	appFlickrOAuth, err := ensureOAuthCredentials()
+	if err != nil {
+		logError(err.Error())
+		return false
+	}
+
+	// Match the local set directories up with Flickr by the set Id in their metadata
+	localDirs := indexSetDirectories()
+
+	rows := []SetReconciliation{}
+	addRow := func(row SetReconciliation) {
+		if dir, ok := localDirs[row.SetId]; ok {
+			metadata, _ := loadSetMetadata(dir)
+			row.Directory = dir
+			row.Metadata = len(metadata.Photos)
+			row.Disk = len(readMediaFiles(dir))
+			delete(localDirs, row.SetId)
+		}
+		row.InSync = row.Flickr == row.Metadata && row.Metadata == row.Disk
+		rows = append(rows, row)
+	}
+
+	flickrSets, err := getSets(context.Background(), appFlickrOAuth)
+	if err != nil {
+		logError(fmt.Sprintf("Could not get the sets from Flickr: %v", err))
+		return false
+	}
+
+	for _, set := range flickrSets.SetContainer.Sets {
+		addRow(SetReconciliation{SetId: set.Id, Title: set.Title, Flickr: set.Photos + set.Videos})
+	}
+
+	notInSet, err := getPhotosNotInSetTotal(context.Background(), appFlickrOAuth)
+	if err != nil {
+		logError(fmt.Sprintf("Could not get the number of media not in a set: %v", err))
+		return false
+	}
+	addRow(SetReconciliation{Title: "NO-SET", Flickr: notInSet})
+
+	// Whatever is left on disk is for sets that were deleted from Flickr
+	leftover := []string{}
+	for setId := range localDirs {
+		leftover = append(leftover, setId)
+	}
+	sort.Strings(leftover)
+	for _, setId := range leftover {
+		// Favorites, galleries and groups aren't sets on Flickr
+		if metadata, _ := loadSetMetadata(localDirs[setId]); metadata.Kind != "" {
+			continue
+		}
+		addRow(SetReconciliation{SetId: setId, Title: filepath.Base(localDirs[setId])})
+	}
+
+	outOfSync := 0
+	for _, row := range rows {
+		if !row.InSync {
+			outOfSync++
+		}
+	}
+
+	if isJsonOutput() {
+		printJson(struct {
+			Sets      []SetReconciliation `json:"sets"`
+			OutOfSync int                 `json:"outOfSync"`
+		}{rows, outOfSync})
+		return true
+	}
+
+	titleWidth := len("Set")
+	for _, row := range rows {
+		if len(row.Title) > titleWidth {
+			titleWidth = len(row.Title)
+		}
+	}
+	if titleWidth > 50 {
+		titleWidth = 50
+	}
+
+	printLine(fmt.Sprintf("  %-*v  %8v  %8v  %8v", titleWidth, "Set", "Flickr", "Metadata", "Disk"))
+	for _, row := range rows {
+		marker := " "
+		if !row.InSync {
+			marker = "*"
 		}
 
-		matches, _ = filepath.Glob(filepath.Join(path, "*.mov"))
-		if matches != nil {
-			movieCount += len(matches)
+		title := row.Title
+		if len(title) > titleWidth {
+			title = title[:titleWidth-3] + "..."
 		}
 
-		return nil
+		printLine(fmt.Sprintf("%v %-*v  %8v  %8v  %8v", marker, titleWidth, title, row.Flickr, row.Metadata, row.Disk))
 	}
 
-	filepath.Walk(*rootDirectory, visitor)
-	return photoCount, movieCount
+	printLine(fmt.Sprintf("%v of %v sets are out of sync (marked with *).", outOfSync, len(rows)))
+	return true
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+var encryptedValuePrefix = "enc:v1:"
+var passphraseEnvVar = "FSYNC_PASSPHRASE"
+var keyDerivationIterations = 600000
+var saltLength = 16
+var keyLength = 32
+var cachedPassphrase = ""
+
+/**
+ * Determines if a stored value was written by encryptValue
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string   The stored value
+ * @return  bool
+**/
+
+func isEncryptedValue(value string) bool {
+
+	return strings.HasPrefix(value, encryptedValuePrefix)
+}
+
+/**
+ * Encrypts a value with a key derived from the passphrase.
+ *
+ * Each value gets its own random salt and nonce, which are stored
+ * alongside the ciphertext: prefix + base64(salt | nonce | ciphertext)
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string          The plaintext value
+ * @param   string          The passphrase
+ * @return  string, error   The encoded encrypted value and any error
+**/
+
+func encryptValue(plaintext string, passphrase string) (string, error) {
+
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	gcm, err := createCipher(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	payload := append(salt, nonce...)
+	payload = gcm.Seal(payload, nonce, []byte(plaintext), nil)
+
+	return encryptedValuePrefix + base64.StdEncoding.EncodeToString(payload), nil
+}
+
+/**
+ * Decrypts a value produced by encryptValue
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string          The encoded encrypted value
+ * @param   string          The passphrase
+ * @return  string, error   The plaintext value and any error
+**/
+
+func decryptValue(value string, passphrase string) (string, error) {
+
+	if !isEncryptedValue(value) {
+		return "", errors.New("value is not encrypted")
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedValuePrefix))
+	if err != nil {
+		return "", err
+	}
+
+	if len(payload) < saltLength {
+		return "", errors.New("encrypted value is too short")
+	}
+
+	salt := payload[:saltLength]
+	gcm, err := createCipher(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+
+	rest := payload[saltLength:]
+	if len(rest) < gcm.NonceSize() {
+		return "", errors.New("encrypted value is too short")
+	}
+
+	plaintext, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("could not decrypt value, the passphrase is probably wrong")
+	}
+
+	return string(plaintext), nil
+}
+
+/**
+ * Creates the AES-GCM cipher for a passphrase and salt
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string              The passphrase
+ * @param   []byte              The salt
+ * @return  cipher.AEAD, error
+**/
+
+func createCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, keyDerivationIterations, keyLength)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+/**
+ * Gets the passphrase used to encrypt credentials. Uses the environment
+ * variable if it is set, so unattended runs work, otherwise prompts the user.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   bool            Ask for the passphrase twice when prompting
+ * @return  string, error   The passphrase and any error
+**/
+
+func getPassphrase(confirm bool) (string, error) {
+
+	if cachedPassphrase != "" {
+		return cachedPassphrase, nil
+	}
+
+	passphrase := os.Getenv(passphraseEnvVar)
+	if passphrase == "" {
+
+		var err error
+		passphrase, err = promptForSecret("Enter the passphrase for your fsync credentials: ")
+		if err != nil {
+			return "", err
+		}
+
+		if confirm {
+			again, err := promptForSecret("Enter the passphrase again: ")
+			if err != nil {
+				return "", err
+			}
+
+			if again != passphrase {
+				return "", errors.New("the passphrases did not match")
+			}
+		}
+	}
+
+	if passphrase == "" {
+		return "", fmt.Errorf("no passphrase given; set %v or enter one at the prompt", passphraseEnvVar)
+	}
+
+	cachedPassphrase = passphrase
+	return passphrase, nil
+}
+
+/**
+ * Prompts for a secret on the terminal, turning off echo where we can
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string          The prompt to show
+ * @return  string, error   What the user typed
+**/
+
+func promptForSecret(prompt string) (string, error) {
+
+	fmt.Print(prompt)
+
+	echoOff := runtime.GOOS == "linux" || runtime.GOOS == "darwin"
+	if echoOff {
+		setTerminalEcho(false)
+		defer func() {
+			setTerminalEcho(true)
+			fmt.Println()
+		}()
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func setTerminalEcho(on bool) {
+
+	arg := "echo"
+	if !on {
+		arg = "-echo"
+	}
+
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	cmd.Run()
+}
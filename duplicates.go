@@ -4,8 +4,30 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 )
 
+var dupesByContent = new(bool)
+
+type DuplicateGroup struct {
+	FileName string   `json:"fileName"`
+	Paths    []string `json:"paths"`
+}
+
+// A group of byte-identical files
+type ContentDuplicateGroup struct {
+	Sha256 string          `json:"sha256"`
+	Size   int64           `json:"size"`
+	Files  []DuplicateFile `json:"files"`
+}
+
+type DuplicateFile struct {
+	Path    string `json:"path"`
+	Set     string `json:"set"`
+	SetId   string `json:"setId"`
+	MediaId string `json:"mediaId"`
+}
+
 /**
  * Finds duplicate media files and lists them to the console
  *
@@ -16,44 +38,201 @@ import (
 
 func findDupes() {
 
+	if *dupesSimilar {
+		findSimilarDupes()
+		return
+	}
+
+	if *dupesByContent {
+		findContentDupes()
+		return
+	}
+
 	duplicates := map[string][]string{}
-	visitor := func(path string, f os.FileInfo, err error) error {
+	walkMediaFiles(func(path string, f os.FileInfo, mediaType *MediaType) {
+		// Files named with their position in the set are the same media in another position
+		fileName := unsequencedFileName(f.Name())
+		duplicates[fileName] = append(duplicates[fileName], path)
+	})
+
+	fileNames := []string{}
+	for fileName := range duplicates {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	var totalDupes = 0
+	groups := []DuplicateGroup{}
+	for _, fileName := range fileNames {
 
-		if f.IsDir() {
-			return nil
+		paths := duplicates[fileName]
+		if len(paths) < 2 {
+			continue
 		}
 
-		if f.Name() == "metadata.json" {
-			return nil
+		totalDupes += len(paths) - 1
+		groups = append(groups, DuplicateGroup{FileName: fileName, Paths: paths})
+		if isJsonOutput() {
+			continue
 		}
 
-		if _, ok := duplicates[f.Name()]; !ok {
-			duplicates[f.Name()] = []string{}
+		logDebug(fmt.Sprintf("File `%v' was found %v times.", fileName, len(paths)))
+		for _, path := range paths {
+			printLine(path)
 		}
+	}
 
-		duplicates[f.Name()] = append(duplicates[f.Name()], path)
+	counts := countMediaFiles()
+	realMediaCount := counts.Total - totalDupes
 
-		return nil
+	if isJsonOutput() {
+		printJson(struct {
+			Groups         []DuplicateGroup `json:"groups"`
+			TotalDupes     int              `json:"totalDupes"`
+			RealMediaCount int              `json:"realMediaCount"`
+		}{groups, totalDupes, realMediaCount})
+		return
 	}
 
-	filepath.Walk(*rootDirectory, visitor)
+	printLine(fmt.Sprintf("Total dupes: %v. Real count of media files: %v", totalDupes, realMediaCount))
+}
+
+/**
+ * Finds byte-identical media files anywhere in the tree and lists them,
+ * with the sets they're in and their Flickr Ids. Only files that share a
+ * size are hashed.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  void
+**/
+
+func findContentDupes() {
+
+	groups := findContentDuplicateGroups()
 
 	var totalDupes = 0
-	for fileName, paths := range duplicates {
+	var wastedBytes int64 = 0
+	for _, group := range groups {
 
-		if len(paths) < 2 {
+		totalDupes += len(group.Files) - 1
+		wastedBytes += int64(len(group.Files)-1) * group.Size
+		if isJsonOutput() {
 			continue
 		}
 
-		totalDupes += len(paths) - 1
-		logMessage(fmt.Sprintf("File `%v' was found %v times.", fileName, len(paths)), false)
+		printLine(fmt.Sprintf("Identical content (%v bytes, SHA-256 %v) was found %v times:", group.Size, group.Sha256, len(group.Files)))
+		for _, file := range group.Files {
+			printLine(fmt.Sprintf("  %v (set `%v', media Id `%v')", file.Path, file.Set, file.MediaId))
+		}
+	}
+
+	counts := countMediaFiles()
+	realMediaCount := counts.Total - totalDupes
+
+	if isJsonOutput() {
+		printJson(struct {
+			Groups         []ContentDuplicateGroup `json:"groups"`
+			TotalDupes     int                     `json:"totalDupes"`
+			WastedBytes    int64                   `json:"wastedBytes"`
+			RealMediaCount int                     `json:"realMediaCount"`
+		}{groups, totalDupes, wastedBytes, realMediaCount})
+		return
+	}
+
+	printLine(fmt.Sprintf("Total dupes: %v, using %v bytes. Real count of media files: %v", totalDupes, wastedBytes, realMediaCount))
+}
+
+/**
+ * Groups the files under the root directory by content: first by size,
+ * then by SHA-256 for the sizes that more than one file has.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  []ContentDuplicateGroup   The groups with more than one file, largest files first
+**/
+
+func findContentDuplicateGroups() []ContentDuplicateGroup {
+
+	bySize := map[int64][]string{}
+	walkMediaFiles(func(path string, f os.FileInfo, mediaType *MediaType) {
+		bySize[f.Size()] = append(bySize[f.Size()], path)
+	})
+
+	groups := []ContentDuplicateGroup{}
+	setMetadata := map[string]SetMetadata{}
+	for size, paths := range bySize {
+
+		if len(paths) < 2 || size == 0 {
+			continue
+		}
+
+		bySha := map[string][]string{}
 		for _, path := range paths {
-			logMessage(path, true)
+			checksum, err := hashFile(path)
+			if err != nil {
+				logWarn(fmt.Sprintf("Could not hash `%v': %v", path, err))
+				continue
+			}
+			bySha[checksum.Sha256] = append(bySha[checksum.Sha256], path)
 		}
+
+		for sha, shaPaths := range bySha {
+
+			if len(shaPaths) < 2 {
+				continue
+			}
+
+			sort.Strings(shaPaths)
+			group := ContentDuplicateGroup{Sha256: sha, Size: size}
+			for _, path := range shaPaths {
+				group.Files = append(group.Files, describeDuplicateFile(path, setMetadata))
+			}
+			groups = append(groups, group)
+		}
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Size != groups[j].Size {
+			return groups[i].Size > groups[j].Size
+		}
+		return groups[i].Sha256 < groups[j].Sha256
+	})
+
+	return groups
+}
+
+/**
+ * Looks up which set a file is in and its Flickr Id
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string                   The full path of the file
+ * @param   map[string]SetMetadata   Metadata already loaded, indexed by directory
+ * @return  DuplicateFile
+**/
+
+func describeDuplicateFile(path string, setMetadata map[string]SetMetadata) DuplicateFile {
+
+	dir := filepath.Dir(path)
+	metadata, ok := setMetadata[dir]
+	if !ok {
+		metadata, _ = loadSetMetadata(dir)
+		setMetadata[dir] = metadata
 	}
 
-	photoCount, movieCount := countMediaFiles()
-	realMediaCount := (photoCount + movieCount) - totalDupes
+	set, err := filepath.Rel(*rootDirectory, dir)
+	if err != nil {
+		set = filepath.Base(dir)
+	}
+
+	file := DuplicateFile{Path: path, Set: set, SetId: metadata.SetId}
+	for _, pm := range metadata.Photos {
+		if pm.Filename == filepath.Base(path) {
+			file.MediaId = pm.PhotoId
+			break
+		}
+	}
 
-	logMessage(fmt.Sprintf("Total dupes: %v. Real count of media files: %v", totalDupes, realMediaCount), true)
+	return file
 }
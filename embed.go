@@ -0,0 +1,975 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+var embedMetadata = new(bool)
+
+// JPEG markers
+var jpegSOI byte = 0xD8
+var jpegSOS byte = 0xDA
+var jpegEOI byte = 0xD9
+var jpegAPP0 byte = 0xE0
+var jpegAPP1 byte = 0xE1
+var jpegAPP13 byte = 0xED
+
+// A segment's length field counts itself, so this is the most data a segment can hold
+var maxSegmentData = 65533
+
+// What the data of the APP segments we write starts with
+var exifHeader = []byte("Exif\x00\x00")
+var xmpHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+var extendedXmpHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+var photoshopHeader = []byte("Photoshop 3.0\x00")
+
+// The Photoshop image resource that holds IPTC-IIM data
+var iptcResourceId uint16 = 0x0404
+
+// The most bytes each IPTC dataset we write may hold, by dataset number in record 2
+var iptcMaxLengths = map[byte]int{5: 64, 25: 64, 55: 8, 60: 11, 80: 32, 116: 128, 120: 2000}
+
+// The datasets in record 2 that hold binary data rather than text
+var iptcBinaryDatasets = map[byte]bool{0: true, 125: true, 200: true, 201: true, 202: true}
+
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+type photoshopResource struct {
+	id   uint16
+	raw  []byte
+	data []byte
+}
+
+type iptcDataset struct {
+	record  byte
+	dataset byte
+	value   []byte
+}
+
+/**
+ * Writes what was curated on Flickr into a downloaded JPEG if -embedMetadata was
+ * given, as XMP, IPTC and EXIF merged with any that is already there, e.g. from
+ * the camera or the photo's editor. Everything else in the file, including the
+ * image data, is copied byte for byte. Failures are logged, since the media
+ * itself is fine.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string          The full path of the media file
+ * @param   *MediaMetadata  The media's metadata, its embedded checksum is set
+ * @param   string          The set Id, for the log
+ * @return  void
+**/
+
+func embedMetadataIfWanted(fullPath string, pm *MediaMetadata, setId string) {
+
+	if !*embedMetadata {
+		return
+	}
+
+	if mediaType := mediaTypeForFile(fullPath); mediaType == nil || mediaType.Name != "jpeg" {
+		return
+	}
+
+	checksum, err := embedJpegMetadata(fullPath, *pm)
+	if err != nil {
+		logWarn(fmt.Sprintf("Could not write the metadata into `%v': %v", fullPath, err), "setId", setId, "photoId", pm.PhotoId)
+		return
+	}
+
+	pm.EmbeddedSha256 = checksum.Sha256
+	pm.EmbeddedSize = checksum.Size
+}
+
+/**
+ * Rewrites a JPEG with the metadata embedded in it
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string                The full path of the JPEG
+ * @param   MediaMetadata         The media's metadata
+ * @return  FileChecksum, error   The checksum of the rewritten file
+**/
+
+func embedJpegMetadata(fullPath string, pm MediaMetadata) (FileChecksum, error) {
+
+	original, err := ioutil.ReadFile(fullPath)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+
+	segments, imageData, err := splitJpeg(original)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+
+	// JFIF comes first, then EXIF, then ours, then the rest in their original order.
+	// Extended XMP is kept as it is, it only holds what didn't fit in the main packet.
+	var leading, exif, rest []jpegSegment
+	var existingExif, existingXmp, resources []byte
+	for i, s := range segments {
+		switch {
+		case s.marker == jpegAPP0 && i == 0:
+			leading = append(leading, s)
+		case s.marker == jpegAPP1 && bytes.HasPrefix(s.data, exifHeader) && existingExif == nil:
+			existingExif = s.data[len(exifHeader):]
+		case s.marker == jpegAPP1 && bytes.HasPrefix(s.data, xmpHeader) && existingXmp == nil:
+			existingXmp = s.data[len(xmpHeader):]
+		case s.marker == jpegAPP13 && bytes.HasPrefix(s.data, photoshopHeader):
+			// Other Photoshop resources, e.g. a thumbnail, are kept
+			resources = append(resources, s.data[len(photoshopHeader):]...)
+		default:
+			rest = append(rest, s)
+		}
+	}
+
+	tiff, err := mergeExif(existingExif, pm)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+	if tiff != nil {
+		data := append(append([]byte{}, exifHeader...), tiff...)
+		if len(data) > maxSegmentData {
+			return FileChecksum{}, errors.New("the EXIF data is too big for a JPEG segment")
+		}
+		exif = append(exif, jpegSegment{jpegAPP1, data})
+	}
+
+	ours := []jpegSegment{}
+
+	packet, err := mergeXmpPacket(existingXmp, pm)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+	xmp := append(append([]byte{}, xmpHeader...), packet...)
+	if len(xmp) > maxSegmentData {
+		return FileChecksum{}, errors.New("the XMP packet is too big for a JPEG segment")
+	}
+	ours = append(ours, jpegSegment{jpegAPP1, xmp})
+
+	existingResources, err := splitPhotoshopResources(resources)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+
+	var existingIptc []byte
+	for _, resource := range existingResources {
+		if resource.id == iptcResourceId {
+			existingIptc = resource.data
+		}
+	}
+
+	iptc, err := mergeIptc(existingIptc, pm)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+
+	resources, err = replacePhotoshopResource(resources, iptcResourceId, iptc)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+	photoshop := append(append([]byte{}, photoshopHeader...), resources...)
+	if len(photoshop) > maxSegmentData {
+		return FileChecksum{}, errors.New("the IPTC data is too big for a JPEG segment")
+	}
+	ours = append(ours, jpegSegment{jpegAPP13, photoshop})
+
+	var out bytes.Buffer
+	out.Write([]byte{0xFF, jpegSOI})
+	for _, group := range [][]jpegSegment{leading, exif, ours, rest} {
+		for _, s := range group {
+			out.Write([]byte{0xFF, s.marker})
+			binary.Write(&out, binary.BigEndian, uint16(len(s.data)+2))
+			out.Write(s.data)
+		}
+	}
+	out.Write(imageData)
+
+	partialPath := fullPath + partialFileSuffix
+	if err := ioutil.WriteFile(partialPath, out.Bytes(), 0644); err != nil {
+		return FileChecksum{}, err
+	}
+	if err := os.Rename(partialPath, fullPath); err != nil {
+		os.Remove(partialPath)
+		return FileChecksum{}, err
+	}
+
+	return hashBytes(out.Bytes()), nil
+}
+
+/**
+ * Splits a JPEG into the segments before the image data, and the image data
+ * itself from the start of scan marker on
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   []byte                          The JPEG
+ * @return  []jpegSegment, []byte, error
+**/
+
+func splitJpeg(contents []byte) ([]jpegSegment, []byte, error) {
+
+	if len(contents) < 4 || contents[0] != 0xFF || contents[1] != jpegSOI {
+		return nil, nil, errors.New("not a JPEG")
+	}
+
+	segments := []jpegSegment{}
+	i := 2
+	for {
+		// Markers can be padded with any number of 0xFF bytes
+		for i < len(contents) && contents[i] == 0xFF && i+1 < len(contents) && contents[i+1] == 0xFF {
+			i++
+		}
+
+		if i+4 > len(contents) || contents[i] != 0xFF {
+			return nil, nil, errors.New("the JPEG is truncated or corrupt")
+		}
+
+		marker := contents[i+1]
+		if marker == jpegSOS || marker == jpegEOI {
+			return segments, contents[i:], nil
+		}
+
+		length := int(binary.BigEndian.Uint16(contents[i+2 : i+4]))
+		if length < 2 || i+2+length > len(contents) {
+			return nil, nil, errors.New("the JPEG is truncated or corrupt")
+		}
+
+		segments = append(segments, jpegSegment{marker, contents[i+4 : i+2+length]})
+		i += 2 + length
+	}
+}
+
+/**
+ * Splits Photoshop image resources, e.g. from an APP13 segment, into single
+ * resources
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   []byte                       The resources
+ * @return  []photoshopResource, error
+**/
+
+func splitPhotoshopResources(resources []byte) ([]photoshopResource, error) {
+
+	split := []photoshopResource{}
+	i := 0
+	for i < len(resources) {
+
+		start := i
+		if i+7 > len(resources) || string(resources[i:i+4]) != "8BIM" {
+			return nil, errors.New("the Photoshop resources are corrupt")
+		}
+		id := binary.BigEndian.Uint16(resources[i+4 : i+6])
+
+		// The name is a Pascal string padded to an even length
+		nameLength := int(resources[i+6]) + 1
+		nameLength += nameLength % 2
+		i += 6 + nameLength
+		if i+4 > len(resources) {
+			return nil, errors.New("the Photoshop resources are corrupt")
+		}
+
+		size := int(binary.BigEndian.Uint32(resources[i : i+4]))
+		i += 4
+		if size < 0 || i+size+size%2 > len(resources) {
+			return nil, errors.New("the Photoshop resources are corrupt")
+		}
+
+		split = append(split, photoshopResource{id, resources[start : i+size+size%2], resources[i : i+size]})
+		i += size + size%2
+	}
+
+	return split, nil
+}
+
+/**
+ * Replaces one resource in a list of Photoshop image resources, or adds it if
+ * it isn't there
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   []byte           The resources
+ * @param   uint16           The Id of the resource to replace
+ * @param   []byte           Its new data
+ * @return  []byte, error    The new resources
+**/
+
+func replacePhotoshopResource(resources []byte, id uint16, data []byte) ([]byte, error) {
+
+	split, err := splitPhotoshopResources(resources)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	for _, resource := range split {
+		if resource.id != id {
+			out.Write(resource.raw)
+		}
+	}
+
+	out.WriteString("8BIM")
+	binary.Write(&out, binary.BigEndian, id)
+	out.Write([]byte{0, 0})
+	binary.Write(&out, binary.BigEndian, uint32(len(data)))
+	out.Write(data)
+	if len(data)%2 == 1 {
+		out.WriteByte(0)
+	}
+
+	return out.Bytes(), nil
+}
+
+/**
+ * Merges our XMP properties into the XMP packet already in a file, e.g. from
+ * the photo's editor. Their values for the properties we write are removed,
+ * whether they are elements or attributes of their rdf:Description, and ours
+ * are added in an rdf:Description of our own. The rest of the packet is kept
+ * as it was written.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   []byte          The XMP packet already in the file, if any
+ * @param   MediaMetadata   The media's metadata
+ * @return  []byte, error
+**/
+
+func mergeXmpPacket(existing []byte, pm MediaMetadata) ([]byte, error) {
+
+	packet := buildXmpPacket(pm)
+
+	// The properties we write are the children of our rdf:Description
+	ours := map[xml.Name]bool{}
+	decoder := xml.NewDecoder(bytes.NewReader(packet))
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 4 {
+				ours[t.Name] = true
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+
+	type xmpElement struct {
+		name        xml.Name
+		start       int64
+		namespaces  map[string]string
+		description bool
+		replaced    bool
+	}
+
+	type xmpEdit struct {
+		start int64
+		end   int64
+		text  []byte
+	}
+
+	rdfDescription := xml.Name{Space: rdfNamespace, Local: "Description"}
+	rdfRoot := xml.Name{Space: rdfNamespace, Local: "RDF"}
+	stack := []xmpElement{}
+	edits := []xmpEdit{}
+	insertAt := int64(-1)
+
+	// Raw tokens keep the prefixes, so a start tag can be written back the way
+	// it was, and we resolve them to name spaces ourselves
+	resolve := func(name xml.Name, attribute bool) xml.Name {
+		if name.Space == "" && attribute {
+			return name
+		}
+		if name.Space == "xml" {
+			return xml.Name{Space: "http://www.w3.org/XML/1998/namespace", Local: name.Local}
+		}
+		for i := len(stack) - 1; i >= 0; i-- {
+			if namespace, ok := stack[i].namespaces[name.Space]; ok {
+				return xml.Name{Space: namespace, Local: name.Local}
+			}
+		}
+		return name
+	}
+
+	decoder = xml.NewDecoder(bytes.NewReader(existing))
+	for {
+		start := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("the XMP is corrupt: %v", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			element := xmpElement{start: start, namespaces: map[string]string{}}
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" {
+					element.namespaces[a.Name.Local] = a.Value
+				} else if a.Name.Space == "" && a.Name.Local == "xmlns" {
+					element.namespaces[""] = a.Value
+				}
+			}
+			stack = append(stack, element)
+
+			current := &stack[len(stack)-1]
+			current.name = resolve(t.Name, false)
+			parent := xmpElement{}
+			if len(stack) > 1 {
+				parent = stack[len(stack)-2]
+			}
+
+			switch {
+			case current.name == rdfDescription && parent.name == rdfRoot:
+				current.description = true
+				kept := []xml.Attr{}
+				for _, a := range t.Attr {
+					if !ours[resolve(a.Name, true)] {
+						kept = append(kept, a)
+					}
+				}
+				if len(kept) < len(t.Attr) {
+					end := decoder.InputOffset()
+					selfClosing := bytes.HasSuffix(existing[:end], []byte("/>"))
+					edits = append(edits, xmpEdit{start, end, xmlStartTag(t.Name, kept, selfClosing)})
+				}
+			case parent.description && ours[current.name]:
+				current.replaced = true
+			}
+
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return nil, errors.New("the XMP is corrupt")
+			}
+			element := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			// An element that closes itself ends where it starts
+			end := decoder.InputOffset()
+			switch {
+			case element.replaced:
+				from := element.start
+				for from > 0 && bytes.IndexByte([]byte(" \t\r\n"), existing[from-1]) >= 0 {
+					from--
+				}
+				edits = append(edits, xmpEdit{from, end, nil})
+			case element.name == rdfRoot && end > start && insertAt < 0:
+				insertAt = start
+				for insertAt > 0 && (existing[insertAt-1] == ' ' || existing[insertAt-1] == '\t') {
+					insertAt--
+				}
+			}
+		}
+	}
+
+	// Without RDF there are no properties to keep
+	if insertAt < 0 {
+		return packet, nil
+	}
+
+	// Their packet may use another prefix for RDF
+	description := bytes.Replace(buildXmpDescription(pm), []byte("<rdf:Description "), []byte("<rdf:Description xmlns:rdf=\""+rdfNamespace+"\" "), 1)
+	edits = append(edits, xmpEdit{insertAt, insertAt, description})
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+
+	var out bytes.Buffer
+	last := int64(0)
+	for _, e := range edits {
+		out.Write(existing[last:e.start])
+		out.Write(e.text)
+		last = e.end
+	}
+	out.Write(existing[last:])
+
+	return out.Bytes(), nil
+}
+
+// Writes a start tag with the prefixes it was read with
+func xmlStartTag(name xml.Name, attributes []xml.Attr, selfClosing bool) []byte {
+
+	qualified := func(name xml.Name) string {
+		if name.Space == "" {
+			return name.Local
+		}
+		return name.Space + ":" + name.Local
+	}
+
+	var b bytes.Buffer
+	b.WriteString("<" + qualified(name))
+	for _, a := range attributes {
+		b.WriteString(" " + qualified(a.Name) + "=\"" + xmlEscape(a.Value) + "\"")
+	}
+	if selfClosing {
+		b.WriteString("/>")
+	} else {
+		b.WriteString(">")
+	}
+
+	return b.Bytes()
+}
+
+/**
+ * Merges our IPTC-IIM data into the IPTC data already in a file. Ours replaces
+ * the datasets we write, and the rest is kept, e.g. a copyright notice or city
+ * from the photo's editor. Ours declares everything to be UTF-8, so text that
+ * isn't is converted from Latin-1, which is what most editors that don't use
+ * UTF-8 write.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   []byte          The IPTC data already in the file, if any
+ * @param   MediaMetadata   The media's metadata
+ * @return  []byte, error
+**/
+
+func mergeIptc(existing []byte, pm MediaMetadata) ([]byte, error) {
+
+	theirs, err := parseIptc(existing)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := buildIptc(pm)
+	ours := map[[2]byte]bool{}
+	for _, d := range merged {
+		ours[[2]byte{d.record, d.dataset}] = true
+	}
+
+	for _, d := range theirs {
+		if ours[[2]byte{d.record, d.dataset}] {
+			continue
+		}
+		if d.record == 2 && !iptcBinaryDatasets[d.dataset] && !utf8.Valid(d.value) {
+			latin1 := []rune{}
+			for _, b := range d.value {
+				latin1 = append(latin1, rune(b))
+			}
+			d.value = []byte(string(latin1))
+		}
+		merged = append(merged, d)
+	}
+
+	// Records go in order, and the record version comes first in its record
+	sort.SliceStable(merged, func(i, j int) bool {
+		if merged[i].record != merged[j].record {
+			return merged[i].record < merged[j].record
+		}
+		return merged[i].dataset == 0 && merged[j].dataset != 0
+	})
+
+	var out bytes.Buffer
+	for _, d := range merged {
+		out.Write([]byte{0x1C, d.record, d.dataset})
+		if len(d.value) > 32767 {
+			// Longer values have the length of their length first
+			binary.Write(&out, binary.BigEndian, uint16(0x8004))
+			binary.Write(&out, binary.BigEndian, uint32(len(d.value)))
+		} else {
+			binary.Write(&out, binary.BigEndian, uint16(len(d.value)))
+		}
+		out.Write(d.value)
+	}
+
+	return out.Bytes(), nil
+}
+
+/**
+ * Splits IPTC-IIM data into its datasets
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   []byte                  The IPTC data
+ * @return  []iptcDataset, error
+**/
+
+func parseIptc(data []byte) ([]iptcDataset, error) {
+
+	datasets := []iptcDataset{}
+	i := 0
+	for i < len(data) && data[i] == 0x1C {
+
+		if i+5 > len(data) {
+			return nil, errors.New("the IPTC data is corrupt")
+		}
+		record, dataset := data[i+1], data[i+2]
+		length := int(binary.BigEndian.Uint16(data[i+3 : i+5]))
+		i += 5
+
+		// Longer values have the length of their length first
+		if length&0x8000 != 0 {
+			n := length & 0x7FFF
+			if n > 4 || i+n > len(data) {
+				return nil, errors.New("the IPTC data is corrupt")
+			}
+			length = 0
+			for _, b := range data[i : i+n] {
+				length = length<<8 | int(b)
+			}
+			i += n
+		}
+
+		if i+length > len(data) {
+			return nil, errors.New("the IPTC data is corrupt")
+		}
+		datasets = append(datasets, iptcDataset{record, dataset, data[i : i+length]})
+		i += length
+	}
+
+	// Anything after the datasets is padding
+	for ; i < len(data); i++ {
+		if data[i] != 0 {
+			return nil, errors.New("the IPTC data is corrupt")
+		}
+	}
+
+	return datasets, nil
+}
+
+/**
+ * Builds IPTC-IIM datasets with the title, description, keywords, date taken
+ * and license, in UTF-8. Values longer than their dataset allows are cut short
+ * at the end of a character.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   MediaMetadata   The media's metadata
+ * @return  []iptcDataset
+**/
+
+func buildIptc(pm MediaMetadata) []iptcDataset {
+
+	datasets := []iptcDataset{}
+	add := func(record byte, dataset byte, value string) {
+		if max, ok := iptcMaxLengths[dataset]; ok && record == 2 && len(value) > max {
+			for max > 0 && !utf8.RuneStart(value[max]) {
+				max--
+			}
+			value = value[:max]
+		}
+		datasets = append(datasets, iptcDataset{record, dataset, []byte(value)})
+	}
+
+	// The coded character set is UTF-8, and the record version 4
+	add(1, 90, "\x1b%G")
+	add(2, 0, "\x00\x04")
+
+	if pm.Title != "" {
+		add(2, 5, pm.Title)
+	}
+	if pm.OwnerName != "" {
+		add(2, 80, pm.OwnerName)
+	}
+	for _, tag := range pm.Tags {
+		add(2, 25, tag)
+	}
+	if taken, err := time.Parse("2006-01-02 15:04:05", pm.DateTaken); err == nil {
+		add(2, 55, taken.Format("20060102"))
+		add(2, 60, taken.Format("150405"))
+	}
+	if license, ok := flickrLicenses[pm.License]; ok {
+		add(2, 116, license.Name)
+	}
+	if pm.Description != "" {
+		add(2, 120, pm.Description)
+	}
+
+	return datasets
+}
+
+// A TIFF tag for EXIF. Entries read from a file keep their value field as it
+// is, which points to the value if it doesn't fit.
+type exifEntry struct {
+	tag   uint16
+	kind  uint16
+	count uint32
+	data  []byte
+}
+
+// TIFF field types
+var tiffByte uint16 = 1
+var tiffAscii uint16 = 2
+var tiffLong uint16 = 4
+var tiffRational uint16 = 5
+var tiffUndefined uint16 = 7
+
+// The tags that say which version of EXIF or GPS tags an IFD has
+var exifVersionTags = map[uint16]bool{0x9000: true, 0x0000: true}
+
+/**
+ * Merges our EXIF tags, the description, date taken and location, into the
+ * EXIF data already in a file, e.g. from the camera. Ours replace the tags we
+ * write and the rest are kept. Nothing in their TIFF structure moves, since
+ * maker notes point into it: the IFDs we change are written again after it,
+ * with our tags, and the old ones are left unused.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   []byte          The TIFF structure already in the file, if any
+ * @param   MediaMetadata   The media's metadata
+ * @return  []byte, error   The new TIFF structure, or nil if there is nothing to write
+**/
+
+func mergeExif(existing []byte, pm MediaMetadata) ([]byte, error) {
+
+	tiff := existing
+	if len(tiff) == 0 {
+		// A header without any IFDs
+		tiff = []byte("II*\x00\x00\x00\x00\x00")
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case len(tiff) >= 8 && string(tiff[:4]) == "II*\x00":
+		order = binary.LittleEndian
+	case len(tiff) >= 8 && string(tiff[:4]) == "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("the EXIF data is corrupt")
+	}
+
+	ascii := func(tag uint16, value string) exifEntry {
+		return exifEntry{tag, tiffAscii, uint32(len(value) + 1), append([]byte(value), 0)}
+	}
+
+	ours := map[uint16][]exifEntry{}
+
+	description := pm.Description
+	if description == "" {
+		description = pm.Title
+	}
+	if description != "" {
+		ours[0] = append(ours[0], ascii(0x010E, description))
+	}
+
+	if taken, err := time.Parse("2006-01-02 15:04:05", pm.DateTaken); err == nil {
+		ours[0x8769] = append(ours[0x8769], exifEntry{0x9000, tiffUndefined, 4, []byte("0232")})
+		ours[0x8769] = append(ours[0x8769], ascii(0x9003, taken.Format("2006:01:02 15:04:05")))
+	}
+
+	if pm.Latitude != 0 || pm.Longitude != 0 {
+		latitudeRef, longitudeRef := "N", "E"
+		if pm.Latitude < 0 {
+			latitudeRef = "S"
+		}
+		if pm.Longitude < 0 {
+			longitudeRef = "W"
+		}
+		ours[0x8825] = append(ours[0x8825], exifEntry{0x0000, tiffByte, 4, []byte{2, 2, 0, 0}})
+		ours[0x8825] = append(ours[0x8825], ascii(0x0001, latitudeRef))
+		ours[0x8825] = append(ours[0x8825], exifEntry{0x0002, tiffRational, 3, exifDegrees(pm.Latitude, order)})
+		ours[0x8825] = append(ours[0x8825], ascii(0x0003, longitudeRef))
+		ours[0x8825] = append(ours[0x8825], exifEntry{0x0004, tiffRational, 3, exifDegrees(pm.Longitude, order)})
+	}
+
+	if len(ours) == 0 {
+		if len(existing) == 0 {
+			return nil, nil
+		}
+		return existing, nil
+	}
+
+	ifd0, next, err := readExifIfd(tiff, order.Uint32(tiff[4:]), order)
+	if err != nil {
+		return nil, err
+	}
+
+	// The pointers to the sub IFDs are filled in once we know where they go,
+	// which doesn't change the size of IFD0
+	long := func(tag uint16, value uint32) exifEntry {
+		data := make([]byte, 4)
+		order.PutUint32(data, value)
+		return exifEntry{tag, tiffLong, 1, data}
+	}
+
+	subIfds := map[uint16][]exifEntry{}
+	for _, pointer := range []uint16{0x8769, 0x8825} {
+
+		if len(ours[pointer]) == 0 {
+			continue
+		}
+
+		theirs := []exifEntry{}
+		for _, e := range ifd0 {
+			if e.tag == pointer {
+				if theirs, _, err = readExifIfd(tiff, order.Uint32(e.data), order); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		subIfds[pointer] = mergeExifEntries(theirs, ours[pointer])
+		ours[0] = append(ours[0], long(pointer, 0))
+	}
+	ifd0 = mergeExifEntries(ifd0, ours[0])
+
+	var out bytes.Buffer
+	out.Write(tiff)
+	if out.Len()%2 == 1 {
+		out.WriteByte(0)
+	}
+
+	offsets := map[uint16]uint32{}
+	offset := uint32(out.Len())
+	end := offset + exifIfdSize(ifd0)
+	for _, pointer := range []uint16{0x8769, 0x8825} {
+		offsets[pointer] = end
+		end += exifIfdSize(subIfds[pointer])
+	}
+	for i := range ifd0 {
+		if _, ok := subIfds[ifd0[i].tag]; ok {
+			ifd0[i] = long(ifd0[i].tag, offsets[ifd0[i].tag])
+		}
+	}
+
+	writeExifIfd(&out, ifd0, offset, next, order)
+	for _, pointer := range []uint16{0x8769, 0x8825} {
+		writeExifIfd(&out, subIfds[pointer], offsets[pointer], 0, order)
+	}
+
+	merged := out.Bytes()
+	order.PutUint32(merged[4:], offset)
+	return merged, nil
+}
+
+// Reads the entries of an IFD as they are, with the values that don't fit in
+// an entry left where they are in the TIFF structure
+func readExifIfd(tiff []byte, offset uint32, order binary.ByteOrder) ([]exifEntry, uint32, error) {
+
+	entries := []exifEntry{}
+	if offset == 0 {
+		return entries, 0, nil
+	}
+
+	if int64(offset)+2 > int64(len(tiff)) {
+		return nil, 0, errors.New("the EXIF data is corrupt")
+	}
+	count := int64(order.Uint16(tiff[offset:]))
+	end := int64(offset) + 2 + 12*count
+	if end > int64(len(tiff)) {
+		return nil, 0, errors.New("the EXIF data is corrupt")
+	}
+
+	for i := int64(0); i < count; i++ {
+		e := tiff[int64(offset)+2+12*i:]
+		entries = append(entries, exifEntry{order.Uint16(e), order.Uint16(e[2:]), order.Uint32(e[4:]), e[8:12]})
+	}
+
+	// Some writers leave out the pointer to the next IFD after the last one
+	next := uint32(0)
+	if end+4 <= int64(len(tiff)) {
+		next = order.Uint32(tiff[end:])
+	}
+
+	return entries, next, nil
+}
+
+// Replaces their entries with ours, except the versions, which describe theirs
+func mergeExifEntries(theirs []exifEntry, ours []exifEntry) []exifEntry {
+
+	replaced := map[uint16]bool{}
+	for _, e := range ours {
+		replaced[e.tag] = true
+	}
+
+	merged := []exifEntry{}
+	kept := map[uint16]bool{}
+	for _, e := range theirs {
+		if !replaced[e.tag] || exifVersionTags[e.tag] {
+			merged = append(merged, e)
+			kept[e.tag] = true
+		}
+	}
+	for _, e := range ours {
+		if !kept[e.tag] {
+			merged = append(merged, e)
+		}
+	}
+
+	// Entries go in the order of their tags
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].tag < merged[j].tag })
+	return merged
+}
+
+func exifIfdSize(entries []exifEntry) uint32 {
+
+	if len(entries) == 0 {
+		return 0
+	}
+
+	size := uint32(2 + 12*len(entries) + 4)
+	for _, e := range entries {
+		if len(e.data) > 4 {
+			size += uint32(len(e.data) + len(e.data)%2)
+		}
+	}
+
+	return size
+}
+
+func writeExifIfd(out *bytes.Buffer, entries []exifEntry, offset uint32, next uint32, order binary.ByteOrder) {
+
+	if len(entries) == 0 {
+		return
+	}
+
+	// Values that don't fit in an entry go after the entries
+	dataOffset := offset + uint32(2+12*len(entries)+4)
+	var data bytes.Buffer
+
+	binary.Write(out, order, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(out, order, e.tag)
+		binary.Write(out, order, e.kind)
+		binary.Write(out, order, e.count)
+		if len(e.data) <= 4 {
+			value := make([]byte, 4)
+			copy(value, e.data)
+			out.Write(value)
+		} else {
+			binary.Write(out, order, dataOffset+uint32(data.Len()))
+			data.Write(e.data)
+			if len(e.data)%2 == 1 {
+				data.WriteByte(0)
+			}
+		}
+	}
+	binary.Write(out, order, next)
+	out.Write(data.Bytes())
+}
+
+// Degrees, minutes and seconds as three EXIF rationals, seconds to 1/1000
+func exifDegrees(value float64, order binary.ByteOrder) []byte {
+
+	value = math.Abs(value)
+	degrees := math.Floor(value)
+	minutes := math.Floor((value - degrees) * 60)
+	seconds := math.Round(((value-degrees)*60 - minutes) * 60 * 1000)
+
+	data := make([]byte, 24)
+	for i, v := range []uint32{uint32(degrees), 1, uint32(minutes), 1, uint32(seconds), 1000} {
+		order.PutUint32(data[i*4:], v)
+	}
+
+	return data
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testMedia = MediaMetadata{
+	PhotoId:     "12345",
+	Title:       "Harbour at dusk",
+	Description: "Boats coming in",
+	OwnerName:   "Ada",
+	Tags:        []string{"harbour", "boats"},
+	DateTaken:   "2015-06-01 14:30:00",
+	Latitude:    -33.856784,
+	Longitude:   151.215297,
+	License:     "4",
+}
+
+// A small but real JPEG, with the given segments after the start of image marker
+func testJpeg(t *testing.T, segments ...jpegSegment) []byte {
+
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 16), 128, 255})
+		}
+	}
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	out.Write(encoded.Bytes()[:2])
+	for _, s := range segments {
+		out.Write([]byte{0xFF, s.marker})
+		binary.Write(&out, binary.BigEndian, uint16(len(s.data)+2))
+		out.Write(s.data)
+	}
+	out.Write(encoded.Bytes()[2:])
+	return out.Bytes()
+}
+
+func writeTestJpeg(t *testing.T, contents []byte) string {
+
+	fullPath := filepath.Join(t.TempDir(), "12345_abcdef_o.jpg")
+	if err := ioutil.WriteFile(fullPath, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fullPath
+}
+
+func testIptc(datasets ...iptcDataset) []byte {
+
+	var out bytes.Buffer
+	for _, d := range datasets {
+		out.Write([]byte{0x1C, d.record, d.dataset})
+		binary.Write(&out, binary.BigEndian, uint16(len(d.value)))
+		out.Write(d.value)
+	}
+	return out.Bytes()
+}
+
+func testPhotoshopSegment(resources ...[]byte) jpegSegment {
+
+	// IPTC first, then a thumbnail
+	var data []byte
+	for i, resource := range resources {
+		var err error
+		data, err = replacePhotoshopResource(data, uint16(0x0404+i*5), resource)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return jpegSegment{jpegAPP13, append(append([]byte{}, photoshopHeader...), data...)}
+}
+
+// Finds the segments with a header, e.g. the EXIF ones
+func findSegments(t *testing.T, contents []byte, marker byte, header []byte) [][]byte {
+
+	segments, _, err := splitJpeg(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := [][]byte{}
+	for _, s := range segments {
+		if s.marker == marker && bytes.HasPrefix(s.data, header) {
+			found = append(found, s.data[len(header):])
+		}
+	}
+	return found
+}
+
+func findIptc(t *testing.T, contents []byte) []iptcDataset {
+
+	photoshop := findSegments(t, contents, jpegAPP13, photoshopHeader)
+	if len(photoshop) != 1 {
+		t.Fatalf("expected 1 Photoshop segment, found %v", len(photoshop))
+	}
+
+	resources, err := splitPhotoshopResources(photoshop[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, resource := range resources {
+		if resource.id == iptcResourceId {
+			datasets, err := parseIptc(resource.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return datasets
+		}
+	}
+
+	t.Fatal("no IPTC resource")
+	return nil
+}
+
+func iptcValues(datasets []iptcDataset, record byte, dataset byte) []string {
+
+	values := []string{}
+	for _, d := range datasets {
+		if d.record == record && d.dataset == dataset {
+			values = append(values, string(d.value))
+		}
+	}
+	return values
+}
+
+// Reads the entries of a TIFF IFD, with the values that don't fit in an entry
+// read from where they point to, and the offset of the next IFD
+func readTestIfd(t *testing.T, tiff []byte, offset uint32) (map[uint16][]byte, uint32) {
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if string(tiff[:2]) == "MM" {
+		order = binary.BigEndian
+	}
+
+	sizes := map[uint16]uint32{tiffByte: 1, tiffAscii: 1, 3: 2, tiffLong: 4, tiffRational: 8, tiffUndefined: 1}
+	entries := map[uint16][]byte{}
+
+	count := order.Uint16(tiff[offset:])
+	for i := uint32(0); i < uint32(count); i++ {
+		entry := tiff[offset+2+i*12:]
+		tag := order.Uint16(entry)
+		size := sizes[order.Uint16(entry[2:])] * order.Uint32(entry[4:])
+		if size <= 4 {
+			entries[tag] = entry[8 : 8+size]
+		} else {
+			valueOffset := order.Uint32(entry[8:])
+			entries[tag] = tiff[valueOffset : valueOffset+size]
+		}
+	}
+
+	return entries, order.Uint32(tiff[offset+2+uint32(count)*12:])
+}
+
+func TestEmbedJpegMetadata(t *testing.T) {
+
+	original := testJpeg(t, jpegSegment{jpegAPP0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")})
+	fullPath := writeTestJpeg(t, original)
+
+	checksum, err := embedJpegMetadata(fullPath, testMedia)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	embedded, err := ioutil.ReadFile(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if checksum != hashBytes(embedded) {
+		t.Error("the checksum isn't the checksum of the file")
+	}
+
+	if _, err := jpeg.Decode(bytes.NewReader(embedded)); err != nil {
+		t.Fatalf("the JPEG can't be decoded anymore: %v", err)
+	}
+
+	_, originalImage, _ := splitJpeg(original)
+	segments, embeddedImage, err := splitJpeg(embedded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(originalImage, embeddedImage) {
+		t.Error("the image data changed")
+	}
+	if segments[0].marker != jpegAPP0 {
+		t.Error("JFIF isn't the first segment anymore")
+	}
+
+	xmp := findSegments(t, embedded, jpegAPP1, xmpHeader)
+	if len(xmp) != 1 || !strings.Contains(string(xmp[0]), "Harbour at dusk") {
+		t.Errorf("expected 1 XMP packet with the title, found %q", xmp)
+	}
+
+	iptc := findIptc(t, embedded)
+	if iptc[0].record != 1 || iptc[0].dataset != 90 || string(iptc[0].value) != "\x1b%G" {
+		t.Error("the IPTC data doesn't start by declaring UTF-8")
+	}
+	for _, expected := range []struct {
+		dataset byte
+		values  string
+	}{
+		{5, "Harbour at dusk"},
+		{25, "harbour,boats"},
+		{55, "20150601"},
+		{60, "143000"},
+		{80, "Ada"},
+		{116, "Attribution License"},
+		{120, "Boats coming in"},
+	} {
+		if values := strings.Join(iptcValues(iptc, 2, expected.dataset), ","); values != expected.values {
+			t.Errorf("IPTC 2:%v is %q, expected %q", expected.dataset, values, expected.values)
+		}
+	}
+
+	exif := findSegments(t, embedded, jpegAPP1, exifHeader)
+	if len(exif) != 1 {
+		t.Fatalf("expected 1 EXIF segment, found %v", len(exif))
+	}
+	tiff := exif[0]
+	if string(tiff[:4]) != "II*\x00" {
+		t.Fatalf("the EXIF doesn't start with a TIFF header: %q", tiff[:4])
+	}
+
+	ifd0, next := readTestIfd(t, tiff, binary.LittleEndian.Uint32(tiff[4:]))
+	if string(ifd0[0x010E]) != "Boats coming in\x00" {
+		t.Errorf("the image description is %q", ifd0[0x010E])
+	}
+	if next != 0 {
+		t.Errorf("expected one IFD, the next one is at %v", next)
+	}
+
+	exifIfd, _ := readTestIfd(t, tiff, binary.LittleEndian.Uint32(ifd0[0x8769]))
+	if string(exifIfd[0x9003]) != "2015:06:01 14:30:00\x00" {
+		t.Errorf("the date taken is %q", exifIfd[0x9003])
+	}
+
+	gps, _ := readTestIfd(t, tiff, binary.LittleEndian.Uint32(ifd0[0x8825]))
+	if string(gps[0x0001]) != "S\x00" || string(gps[0x0003]) != "E\x00" {
+		t.Errorf("the GPS references are %q and %q", gps[0x0001], gps[0x0003])
+	}
+
+	latitude := []uint32{}
+	for i := 0; i < 6; i++ {
+		latitude = append(latitude, binary.LittleEndian.Uint32(gps[0x0002][i*4:]))
+	}
+	if latitude[0] != 33 || latitude[1] != 1 || latitude[2] != 51 || latitude[3] != 1 || latitude[4] != 24422 || latitude[5] != 1000 {
+		t.Errorf("the latitude is %v", latitude)
+	}
+}
+
+func TestEmbedJpegMetadataKeepsExistingMetadata(t *testing.T) {
+
+	camera, err := mergeExif(nil, MediaMetadata{Title: "From the camera", DateTaken: "2010-01-01 10:00:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exif := jpegSegment{jpegAPP1, append(append([]byte{}, exifHeader...), camera...)}
+	iptc := testIptc(
+		iptcDataset{2, 0, []byte{0, 4}},
+		iptcDataset{2, 5, []byte("Old title")},
+		iptcDataset{2, 90, []byte("Sydney")},
+		iptcDataset{2, 116, []byte("© Ada")},
+	)
+	thumbnail := []byte("not really a thumbnail")
+	original := testJpeg(t, exif, testPhotoshopSegment(iptc, thumbnail))
+	fullPath := writeTestJpeg(t, original)
+
+	if _, err := embedJpegMetadata(fullPath, MediaMetadata{PhotoId: "12345", Title: "Harbour at dusk"}); err != nil {
+		t.Fatal(err)
+	}
+
+	embedded, err := ioutil.ReadFile(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := findSegments(t, embedded, jpegAPP1, exifHeader)
+	if len(found) != 1 || len(found[0]) < len(camera) || !bytes.Equal(found[0][8:len(camera)], camera[8:]) {
+		t.Fatal("the EXIF that was there moved")
+	}
+	ifd0, _ := readTestIfd(t, found[0], binary.LittleEndian.Uint32(found[0][4:]))
+	if string(ifd0[0x010E]) != "Harbour at dusk\x00" {
+		t.Errorf("the image description is %q, expected ours", ifd0[0x010E])
+	}
+	exifIfd, _ := readTestIfd(t, found[0], binary.LittleEndian.Uint32(ifd0[0x8769]))
+	if string(exifIfd[0x9003]) != "2010:01:01 10:00:00\x00" {
+		t.Errorf("the date taken is %q, expected it to be kept", exifIfd[0x9003])
+	}
+
+	datasets := findIptc(t, embedded)
+	if values := iptcValues(datasets, 2, 5); len(values) != 1 || values[0] != "Harbour at dusk" {
+		t.Errorf("the title is %q, expected ours", values)
+	}
+	if values := iptcValues(datasets, 2, 90); len(values) != 1 || values[0] != "Sydney" {
+		t.Errorf("the city is %q, expected it to be kept", values)
+	}
+	if values := iptcValues(datasets, 2, 116); len(values) != 1 || values[0] != "© Ada" {
+		t.Errorf("the copyright notice is %q, expected it to be kept", values)
+	}
+	if values := iptcValues(datasets, 2, 0); len(values) != 1 || datasets[1].dataset != 0 {
+		t.Error("expected one record version, first in record 2")
+	}
+
+	resources, err := splitPhotoshopResources(findSegments(t, embedded, jpegAPP13, photoshopHeader)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 2 || resources[0].id != 0x0409 || !bytes.Equal(resources[0].data, thumbnail) {
+		t.Error("the other Photoshop resource wasn't kept")
+	}
+}
+
+func TestEmbedJpegMetadataMergesXmp(t *testing.T) {
+
+	// From an editor, with RDF as the default name space and properties as attributes
+	theirs := `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <RDF xmlns="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <Description xmlns:d="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"
+    xmp:CreatorTool="Lightroom" photoshop:DateCreated="2001-01-01">
+   <d:title>
+    <Alt>
+     <li xml:lang="x-default">Old title</li>
+    </Alt>
+   </d:title>
+   <d:rights>
+    <Alt>
+     <li xml:lang="x-default">© Ada</li>
+    </Alt>
+   </d:rights>
+  </Description>
+ </RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+	extended := append(append([]byte{}, extendedXmpHeader...), []byte("0123456789ABCDEF0123456789ABCDEF")...)
+	original := testJpeg(t, jpegSegment{jpegAPP1, append(append([]byte{}, xmpHeader...), theirs...)}, jpegSegment{jpegAPP1, extended})
+	fullPath := writeTestJpeg(t, original)
+
+	if _, err := embedJpegMetadata(fullPath, testMedia); err != nil {
+		t.Fatal(err)
+	}
+
+	embedded, err := ioutil.ReadFile(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xmp := findSegments(t, embedded, jpegAPP1, xmpHeader)
+	if len(xmp) != 1 {
+		t.Fatalf("expected 1 XMP packet, found %v", len(xmp))
+	}
+	packet := string(xmp[0])
+
+	decoder := xml.NewDecoder(strings.NewReader(packet))
+	for {
+		if _, err := decoder.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("the XMP packet isn't well formed: %v\n%v", err, packet)
+		}
+	}
+
+	for _, kept := range []string{`xmp:CreatorTool="Lightroom"`, "© Ada", "Harbour at dusk", "<dc:subject>"} {
+		if !strings.Contains(packet, kept) {
+			t.Errorf("expected %q in the XMP packet:\n%v", kept, packet)
+		}
+	}
+	for _, replaced := range []string{"Old title", "2001-01-01", "<d:title>"} {
+		if strings.Contains(packet, replaced) {
+			t.Errorf("expected %q to be replaced in the XMP packet:\n%v", replaced, packet)
+		}
+	}
+
+	if found := findSegments(t, embedded, jpegAPP1, extendedXmpHeader); len(found) != 1 || !bytes.Equal(found[0], extended[len(extendedXmpHeader):]) {
+		t.Error("the extended XMP wasn't kept")
+	}
+
+	// A packet without RDF has nothing to keep
+	merged, err := mergeXmpPacket([]byte("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\"/>"), testMedia)
+	if err != nil || !bytes.Equal(merged, buildXmpPacket(testMedia)) {
+		t.Errorf("expected our packet, got %q, %v", merged, err)
+	}
+}
+
+func TestMergeExifKeepsTheCamerasTags(t *testing.T) {
+
+	// A big endian TIFF structure with a maker note and a thumbnail IFD after IFD0
+	order := binary.BigEndian
+	long := func(tag uint16, value uint32) exifEntry {
+		data := make([]byte, 4)
+		order.PutUint32(data, value)
+		return exifEntry{tag, tiffLong, 1, data}
+	}
+	ifd0 := []exifEntry{
+		{0x010F, tiffAscii, 6, []byte("Canon\x00")},
+		{0x0112, 3, 1, []byte{0, 6}},
+		long(0x8769, 0),
+	}
+	exifIfd := []exifEntry{
+		{0x9000, tiffUndefined, 4, []byte("0230")},
+		{0x9003, tiffAscii, 20, []byte("2010:01:01 10:00:00\x00")},
+		{0x927C, tiffUndefined, 10, []byte("maker note")},
+	}
+	ifd1 := []exifEntry{long(0x0201, 0)}
+	exifOffset := 8 + exifIfdSize(ifd0)
+	ifd1Offset := exifOffset + exifIfdSize(exifIfd)
+	ifd0[2] = long(0x8769, exifOffset)
+
+	var camera bytes.Buffer
+	camera.WriteString("MM\x00*")
+	binary.Write(&camera, order, uint32(8))
+	writeExifIfd(&camera, ifd0, 8, ifd1Offset, order)
+	writeExifIfd(&camera, exifIfd, exifOffset, 0, order)
+	writeExifIfd(&camera, ifd1, ifd1Offset, 0, order)
+
+	merged, err := mergeExif(camera.Bytes(), testMedia)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) < camera.Len() || !bytes.Equal(merged[8:camera.Len()], camera.Bytes()[8:]) {
+		t.Fatal("the camera's TIFF structure moved")
+	}
+
+	mergedIfd0, next := readTestIfd(t, merged, order.Uint32(merged[4:]))
+	if string(mergedIfd0[0x010F]) != "Canon\x00" || !bytes.Equal(mergedIfd0[0x0112], []byte{0, 6}) {
+		t.Errorf("the make and orientation weren't kept: %q, %v", mergedIfd0[0x010F], mergedIfd0[0x0112])
+	}
+	if string(mergedIfd0[0x010E]) != "Boats coming in\x00" {
+		t.Errorf("the image description is %q", mergedIfd0[0x010E])
+	}
+	if next != ifd1Offset {
+		t.Errorf("the thumbnail IFD is at %v, expected %v", next, ifd1Offset)
+	}
+
+	mergedExifIfd, _ := readTestIfd(t, merged, order.Uint32(mergedIfd0[0x8769]))
+	if string(mergedExifIfd[0x9000]) != "0230" || string(mergedExifIfd[0x927C]) != "maker note" {
+		t.Errorf("the version and maker note weren't kept: %q, %q", mergedExifIfd[0x9000], mergedExifIfd[0x927C])
+	}
+	if string(mergedExifIfd[0x9003]) != "2015:06:01 14:30:00\x00" {
+		t.Errorf("the date taken is %q", mergedExifIfd[0x9003])
+	}
+
+	gps, _ := readTestIfd(t, merged, order.Uint32(mergedIfd0[0x8825]))
+	if string(gps[0x0001]) != "S\x00" || order.Uint32(gps[0x0002]) != 33 {
+		t.Errorf("the latitude is %q %v", gps[0x0001], gps[0x0002])
+	}
+}
+
+func TestMergeIptcConvertsLatin1(t *testing.T) {
+
+	existing := testIptc(
+		iptcDataset{2, 90, []byte("S\xe3o Paulo")},
+		iptcDataset{2, 202, []byte{0xFF, 0xD8}},
+	)
+	merged, err := mergeIptc(existing, testMedia)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	datasets, err := parseIptc(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := iptcValues(datasets, 2, 90); len(values) != 1 || values[0] != "São Paulo" {
+		t.Errorf("the city is %q", values)
+	}
+	if values := iptcValues(datasets, 2, 202); len(values) != 1 || values[0] != "\xff\xd8" {
+		t.Errorf("the preview is %q, expected it as it was", values)
+	}
+}
+
+func TestBuildIptcCutsValuesShort(t *testing.T) {
+
+	datasets := buildIptc(MediaMetadata{
+		Title:       strings.Repeat("a", 63) + "é",
+		OwnerName:   strings.Repeat("b", 40),
+		Description: "Boats coming in",
+	})
+
+	if values := iptcValues(datasets, 2, 5); len(values) != 1 || values[0] != strings.Repeat("a", 63) {
+		t.Errorf("the title is %q, expected it cut before the é", values)
+	}
+	if values := iptcValues(datasets, 2, 80); len(values) != 1 || values[0] != strings.Repeat("b", 32) {
+		t.Errorf("the owner is %q, expected 32 bytes", values)
+	}
+	if values := iptcValues(datasets, 2, 120); len(values) != 1 || values[0] != "Boats coming in" {
+		t.Errorf("the description is %q", values)
+	}
+}
+
+func TestParseIptc(t *testing.T) {
+
+	long := bytes.Repeat([]byte("a"), 40000)
+	var data bytes.Buffer
+	data.Write([]byte{0x1C, 2, 120, 0x80, 0x04})
+	binary.Write(&data, binary.BigEndian, uint32(len(long)))
+	data.Write(long)
+	data.Write(testIptc(iptcDataset{2, 5, []byte("Title")}))
+	data.Write([]byte{0, 0})
+
+	datasets, err := parseIptc(data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datasets) != 2 || !bytes.Equal(datasets[0].value, long) || string(datasets[1].value) != "Title" {
+		t.Errorf("parsed %v datasets wrong", len(datasets))
+	}
+
+	merged, err := mergeIptc(data.Bytes(), MediaMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reparsed, err := parseIptc(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := iptcValues(reparsed, 2, 120); len(values) != 1 || values[0] != string(long) {
+		t.Error("the long description wasn't kept")
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/xml"
+	"fmt"
 	"sort"
 	"strconv"
 	"strings"
@@ -10,6 +12,12 @@ import (
 var apiBaseUrl = "https://api.flickr.com/services/rest"
 var getPhotosInSetName = "flickr.photosets.getPhotos"
 var getPhotosNotInSetName = "flickr.photos.getNotInSet"
+var getFavoritesName = "flickr.favorites.getList"
+var getGalleryPhotosName = "flickr.galleries.getPhotos"
+var getGroupPoolPhotosName = "flickr.groups.pools.getPhotos"
+
+// The name used for directories of sets, collections and groups without a usable title
+var untitledFileName = "untitled"
 
 type FlickrErrorResponse struct {
 	XMLName xml.Name `xml:"rsp"`
@@ -44,29 +52,99 @@ type Photoset struct {
 	XMLName     xml.Name `xml:"photoset"`
 	Id          string   `xml:"id,attr"`
 	DateCreated int      `xml:"date_create,attr"`
+	DateUpdated int      `xml:"date_update,attr"`
 	Photos      int      `xml:"photos,attr"`
 	Videos      int      `xml:"videos,attr"`
 	Title       string   `xml:"title"`
+	Description string   `xml:"description"`
+	Primary     string   `xml:"primary,attr"`
+
+	// The titles of the collections the set is in, outermost first, with -collections
+	Collections []string `xml:"-"`
+
+	// Empty for the user's own sets, otherwise the kind of virtual set, e.g. a gallery
+	Kind string `xml:"-"`
 }
 
 func (ps Photoset) CleanTitle() string {
 
+	return cleanFileName(ps.Title)
+}
+
+func cleanFileName(title string) string {
+
 	invalidChars := []string{"\\", "/", ":", ">", "<", "?", "\"", "|", "*"}
 
-	title := ps.Title
 	for _, char := range invalidChars {
 		title = strings.Replace(title, char, "", -1)
 	}
 
+	// Titles can be chosen by other people, e.g. group names, and "." or ".."
+	// would put the directory somewhere else entirely
+	if trimmed := strings.TrimSpace(title); trimmed == "" || trimmed == "." || trimmed == ".." {
+		return untitledFileName
+	}
+
 	return title
 }
 
-// Get photos not in a set
+// Get the tree of collections
+type CollectionsResponse struct {
+	XMLName     xml.Name     `xml:"rsp"`
+	Collections []Collection `xml:"collections>collection"`
+}
+
+type Collection struct {
+	Id          string          `xml:"id,attr"`
+	Title       string          `xml:"title,attr"`
+	Collections []Collection    `xml:"collection"`
+	Sets        []CollectionSet `xml:"set"`
+}
+
+type CollectionSet struct {
+	Id string `xml:"id,attr"`
+}
+
+// Get the user's galleries
+type GalleriesResponse struct {
+	XMLName   xml.Name  `xml:"rsp"`
+	Galleries []Gallery `xml:"galleries>gallery"`
+}
+
+type Gallery struct {
+	Id          string `xml:"id,attr"`
+	DateCreated int    `xml:"date_create,attr"`
+	DateUpdated int    `xml:"date_update,attr"`
+	Photos      int    `xml:"count_photos,attr"`
+	Videos      int    `xml:"count_videos,attr"`
+	Primary     string `xml:"primary_photo_id,attr"`
+	Title       string `xml:"title"`
+	Description string `xml:"description"`
+}
+
+// Get a group's name
+type GroupInfoResponse struct {
+	XMLName xml.Name `xml:"rsp"`
+	Group   struct {
+		Id   string `xml:"id,attr"`
+		Name string `xml:"name"`
+	} `xml:"group"`
+}
+
+// Get photos not in a set, and any other listing that isn't a set's
 type PhotosNotInSetResponse struct {
 	XMLName xml.Name `xml:"rsp"`
 	Photos  []Photo  `xml:"photos>photo"`
 }
 
+// Just the total of photos not in a set
+type PhotosNotInSetTotalResponse struct {
+	XMLName xml.Name `xml:"rsp"`
+	Photos  struct {
+		Total int `xml:"total,attr"`
+	} `xml:"photos"`
+}
+
 // Get list of photos from a set
 type PhotosResponse struct {
 	XMLName xml.Name `xml:"rsp"`
@@ -81,11 +159,32 @@ type PhotosPhotoset struct {
 
 // Used by both in-set and not-in-set photos responses
 type Photo struct {
-	XMLName     xml.Name `xml:"photo"`
-	Id          string   `xml:"id,attr"`
-	Title       string   `xml:"title,attr"`
-	OriginalUrl string   `xml:"url_o,attr"`
-	Media       string   `xml:"media,attr"`
+	XMLName      xml.Name `xml:"photo"`
+	Id           string   `xml:"id,attr"`
+	Title        string   `xml:"title,attr"`
+	OriginalUrl  string   `xml:"url_o,attr"`
+	Media        string   `xml:"media,attr"`
+	DateUploaded int64    `xml:"dateupload,attr"`
+
+	// What was curated on Flickr. Tags are separated by spaces, and a location
+	// of 0, 0 means the media isn't geotagged.
+	Description string  `xml:"description"`
+	Tags        string  `xml:"tags,attr"`
+	DateTaken   string  `xml:"datetaken,attr"`
+	Latitude    float64 `xml:"latitude,attr"`
+	Longitude   float64 `xml:"longitude,attr"`
+	License     string  `xml:"license,attr"`
+
+	// When any of that last changed on Flickr, as a unix timestamp
+	LastUpdate int64 `xml:"lastupdate,attr"`
+
+	// Who the media belongs to, for media that isn't the user's own
+	Owner     string `xml:"owner,attr"`
+	OwnerName string `xml:"ownername,attr"`
+
+	// Where the media is in the listing, from 1. For a set that is the order of
+	// the set on Flickr.
+	Position int `xml:"-"`
 }
 
 // Get sizes of photos
@@ -116,28 +215,29 @@ func (a ByDateCreated) Less(i, j int) bool { return a[i].DateCreated < a[j].Date
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
- * @param   FlickrOAuth    The flickr oauth setup
- * @return  PhotosetsResponse
+ * @param   context.Context   Cancels the request
+ * @param   FlickrOAuth       The flickr oauth setup
+ * @return  PhotosetsResponse, error
 **/
 
-func getSets(flickrOAuth FlickrOAuth) PhotosetsResponse {
+func getSets(ctx context.Context, flickrOAuth FlickrOAuth) (PhotosetsResponse, error) {
 
-	body, err := makeGetRequest(func() string { return generateGetSetsUrl(flickrOAuth) })
+	sets := PhotosetsResponse{}
+	body, err := makeGetRequest(ctx, func() string { return generateGetSetsUrl(flickrOAuth) })
 	if err != nil {
-		panic(err)
+		return sets, err
 	}
 
-	sets := PhotosetsResponse{}
 	err = xml.Unmarshal(body, &sets)
 	if err != nil {
-		logMessage("Could not unmarshal body, check logs for body detail.", true)
-		logMessage(string(body), false)
-		panic(err)
+		logError("Could not unmarshal body, check logs for body detail.")
+		logDebug("Response body", "body", string(body))
+		return sets, err
 	}
 
 	sort.Sort(ByDateCreated(sets.SetContainer.Sets))
 
-	return sets
+	return sets, nil
 }
 
 /**
@@ -145,27 +245,62 @@ func getSets(flickrOAuth FlickrOAuth) PhotosetsResponse {
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
- * @param   FlickrOAuth    The flickr oauth setup
- * @return  PhotosetsResponse
+ * @param   context.Context   Cancels the request
+ * @param   FlickrOAuth       The flickr oauth setup
+ * @param   string            The set Id
+ * @return  SinglePhotosetResponse, error
 **/
 
-func getSpecificSet(flickrOAuth FlickrOAuth, setId string) SinglePhotosetResponse {
+func getSpecificSet(ctx context.Context, flickrOAuth FlickrOAuth, setId string) (SinglePhotosetResponse, error) {
 
+	set := SinglePhotosetResponse{}
 	extras := map[string]string{"photoset_id": setId}
-	body, err := makeGetRequest(func() string { return generateOAuthUrl(apiBaseUrl, "flickr.photosets.getInfo", flickrOAuth, extras) })
+	body, err := makeGetRequest(ctx, func() string { return generateOAuthUrl(apiBaseUrl, "flickr.photosets.getInfo", flickrOAuth, extras) })
 	if err != nil {
-		panic(err)
+		return set, err
 	}
 
-	set := SinglePhotosetResponse{}
 	err = xml.Unmarshal(body, &set)
 	if err != nil {
-		logMessage("Could not unmarshal body, check logs for body detail.", true)
-		logMessage(string(body), false)
-		panic(err)
+		logError("Could not unmarshal body, check logs for body detail.", "setId", setId)
+		logDebug("Response body", "setId", setId, "body", string(body))
+		return set, err
+	}
+
+	return set, nil
+}
+
+/**
+ * Gets the user's collections, with the collections and sets in each
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context   Cancels the request
+ * @param   FlickrOAuth       The flickr oauth setup
+ * @return  []Collection, error
+**/
+
+func getCollectionTree(ctx context.Context, flickrOAuth FlickrOAuth) ([]Collection, error) {
+
+	body, err := makeGetRequest(ctx, func() string { return generateOAuthUrl(apiBaseUrl, "flickr.collections.getTree", flickrOAuth, nil) })
+	if err != nil {
+		return nil, err
+	}
+
+	errorResponse := FlickrErrorResponse{}
+	if xml.Unmarshal(body, &errorResponse) == nil && errorResponse.Error.Code != "" {
+		return nil, fmt.Errorf("Flickr error %v: %v", errorResponse.Error.Code, errorResponse.Error.Message)
 	}
 
-	return set
+	response := CollectionsResponse{}
+	err = xml.Unmarshal(body, &response)
+	if err != nil {
+		logError("Could not unmarshal body, check logs for body detail.")
+		logDebug("Response body", "body", string(body))
+		return nil, err
+	}
+
+	return response.Collections, nil
 }
 
 /**
@@ -173,13 +308,15 @@ func getSpecificSet(flickrOAuth FlickrOAuth, setId string) SinglePhotosetRespons
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
- * @param   FlickrOAuth        The flickr oauth setup
- * @return  map[string]Photo   The list of media files, indexed by Flickr Id
+ * @param   context.Context           Cancels the requests
+ * @param   FlickrOAuth               The flickr oauth setup
+ * @param   Photoset                  The set
+ * @return  map[string]Photo, error   The list of media files, indexed by Flickr Id
 **/
 
-func getPhotosForSet(flickrOAuth FlickrOAuth, set Photoset) map[string]Photo {
+func getPhotosForSet(ctx context.Context, flickrOAuth FlickrOAuth, set Photoset) (map[string]Photo, error) {
 
-	return getAllPhotos(flickrOAuth, getPhotosInSetName, set.Id)
+	return getAllPhotos(ctx, flickrOAuth, getPhotosInSetName, set.Id, map[string]string{"photoset_id": set.Id})
 }
 
 /**
@@ -187,13 +324,116 @@ func getPhotosForSet(flickrOAuth FlickrOAuth, set Photoset) map[string]Photo {
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
- * @param   FlickrOAuth        The flickr oauth setup
- * @return  map[string]Photo   The list of media files indexed by Flickr Id
+ * @param   context.Context           Cancels the requests
+ * @param   FlickrOAuth               The flickr oauth setup
+ * @return  map[string]Photo, error   The list of media files indexed by Flickr Id
+**/
+
+func getPhotosNotInSet(ctx context.Context, flickrOAuth FlickrOAuth) (map[string]Photo, error) {
+
+	return getAllPhotos(ctx, flickrOAuth, getPhotosNotInSetName, "", nil)
+}
+
+/**
+ * Gets the user's galleries
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context   Cancels the request
+ * @param   FlickrOAuth       The flickr oauth setup
+ * @return  []Gallery, error
 **/
 
-func getPhotosNotInSet(flickrOAuth FlickrOAuth) map[string]Photo {
+func getGalleries(ctx context.Context, flickrOAuth FlickrOAuth) ([]Gallery, error) {
 
-	return getAllPhotos(flickrOAuth, getPhotosNotInSetName, "")
+	extras := map[string]string{"user_id": flickrOAuth.UserNSID, "per_page": "500"}
+	body, err := makeGetRequest(ctx, func() string { return generateOAuthUrl(apiBaseUrl, "flickr.galleries.getList", flickrOAuth, extras) })
+	if err != nil {
+		return nil, err
+	}
+
+	errorResponse := FlickrErrorResponse{}
+	if xml.Unmarshal(body, &errorResponse) == nil && errorResponse.Error.Code != "" {
+		return nil, fmt.Errorf("Flickr error %v: %v", errorResponse.Error.Code, errorResponse.Error.Message)
+	}
+
+	response := GalleriesResponse{}
+	err = xml.Unmarshal(body, &response)
+	if err != nil {
+		logError("Could not unmarshal body, check logs for body detail.")
+		logDebug("Response body", "body", string(body))
+		return nil, err
+	}
+
+	return response.Galleries, nil
+}
+
+/**
+ * Gets the name of a group
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context   Cancels the request
+ * @param   FlickrOAuth       The flickr oauth setup
+ * @param   string            The group's NSID
+ * @return  string, error
+**/
+
+func getGroupName(ctx context.Context, flickrOAuth FlickrOAuth, groupId string) (string, error) {
+
+	extras := map[string]string{"group_id": groupId}
+	body, err := makeGetRequest(ctx, func() string { return generateOAuthUrl(apiBaseUrl, "flickr.groups.getInfo", flickrOAuth, extras) })
+	if err != nil {
+		return "", err
+	}
+
+	errorResponse := FlickrErrorResponse{}
+	if xml.Unmarshal(body, &errorResponse) == nil && errorResponse.Error.Code != "" {
+		return "", fmt.Errorf("Flickr error %v: %v", errorResponse.Error.Code, errorResponse.Error.Message)
+	}
+
+	response := GroupInfoResponse{}
+	err = xml.Unmarshal(body, &response)
+	if err != nil {
+		logDebug("Response body", "body", string(body))
+		return "", err
+	}
+
+	return response.Group.Name, nil
+}
+
+/**
+ * Gets the number of media files that are not included in a set, without
+ * paging through them all
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context   Cancels the request
+ * @param   FlickrOAuth       The flickr oauth setup
+ * @return  int, error
+**/
+
+func getPhotosNotInSetTotal(ctx context.Context, flickrOAuth FlickrOAuth) (int, error) {
+
+	extras := map[string]string{"page": "1", "per_page": "1"}
+	body, err := makeGetRequest(ctx, func() string { return generateOAuthUrl(apiBaseUrl, getPhotosNotInSetName, flickrOAuth, extras) })
+	if err != nil {
+		return 0, err
+	}
+
+	errorResponse := FlickrErrorResponse{}
+	if xml.Unmarshal(body, &errorResponse) == nil && errorResponse.Error.Code != "" {
+		return 0, fmt.Errorf("Flickr error %v: %v", errorResponse.Error.Code, errorResponse.Error.Message)
+	}
+
+	response := PhotosNotInSetTotalResponse{}
+	err = xml.Unmarshal(body, &response)
+	if err != nil {
+		logDebug("Response body", "body", string(body))
+		return 0, err
+	}
+
+	return response.Photos.Total, nil
 }
 
 /**
@@ -201,16 +441,17 @@ func getPhotosNotInSet(flickrOAuth FlickrOAuth) map[string]Photo {
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
- * @param   FlickrOAuth        The flickr oauth setup
- * @param   string             Which flickr api we're using (with set or w/o)
- * @param   string             The set id of media files we're getting.
- * @return  map[string]Photo   The list of media files indexed by Flickr Id
+ * @param   context.Context           Cancels the requests
+ * @param   FlickrOAuth               The flickr oauth setup
+ * @param   string                    Which flickr api we're using (with set or w/o)
+ * @param   string                    The set id of media files we're getting, for the log
+ * @param   map[string]string         The api's parameters, e.g. the photoset_id
+ * @return  map[string]Photo, error   The list of media files indexed by Flickr Id. Callers must not
+ *                                    treat a failed request as an empty set, or every file would be deleted.
 **/
 
-func getAllPhotos(flickrOAuth FlickrOAuth, apiName string, setId string) map[string]Photo {
+func getAllPhotos(ctx context.Context, flickrOAuth FlickrOAuth, apiName string, setId string, params map[string]string) (map[string]Photo, error) {
 
-	var err error
-	var body []byte
 	photos := map[string]Photo{}
 	currentPage := 1
 	pageSize := 500
@@ -219,59 +460,48 @@ func getAllPhotos(flickrOAuth FlickrOAuth, apiName string, setId string) map[str
 
 		extras := map[string]string{"page": strconv.Itoa(currentPage)}
 		extras["per_page"] = strconv.Itoa(pageSize)
-		extras["extras"] = "media,url_o"
-		if len(setId) > 0 {
-			extras["photoset_id"] = setId
+		extras["extras"] = "media,url_o,date_upload,description,tags,geo,date_taken,license,owner_name,last_update"
+		for name, value := range params {
+			extras[name] = value
 		}
 
-		body, err = makeGetRequest(func() string { return generateOAuthUrl(apiBaseUrl, apiName, flickrOAuth, extras) })
+		body, err := makeGetRequest(ctx, func() string { return generateOAuthUrl(apiBaseUrl, apiName, flickrOAuth, extras) })
 		if err != nil {
-			logMessage("Could not unmarshal body, check logs for body detail.", true)
-			logMessage(string(body), false)
-			return map[string]Photo{}
+			return nil, err
+		}
+
+		// Flickr reports errors in the body. Error code "1" after the first page means we
+		// asked for a page past the end, i.e. the set has a multiple of 500 photos in it,
+		// so we have them all. On the first page it means the set or group wasn't found.
+		errorResponse := FlickrErrorResponse{}
+		if xml.Unmarshal(body, &errorResponse) == nil && errorResponse.Error.Code != "" {
+			if errorResponse.Error.Code == "1" && currentPage > 1 {
+				break
+			}
+
+			logDebug("Response body", "setId", setId, "body", string(body))
+			return nil, fmt.Errorf("Flickr error %v: %v", errorResponse.Error.Code, errorResponse.Error.Message)
 		}
 
 		responsePhotos := []Photo{}
-		var err error
-		if apiName == getPhotosNotInSetName {
-			response := PhotosNotInSetResponse{}
+		if apiName == getPhotosInSetName {
+			response := PhotosResponse{}
 			err = xml.Unmarshal(body, &response)
-			if err == nil {
-				responsePhotos = response.Photos
-			}
+			responsePhotos = response.Set.Photos
 		} else {
-			response := PhotosResponse{}
+			response := PhotosNotInSetResponse{}
 			err = xml.Unmarshal(body, &response)
-			if err == nil {
-				responsePhotos = response.Set.Photos
-			}
+			responsePhotos = response.Photos
 		}
 
 		if err != nil {
-
-			// We couldn't unmarshal the response as photos, but it might be the case
-			// that we just ran out of photos, i.e. the set has a multiple of 500 photos in it
-			// Lets try to unmarshal the response as an error, and if it is, error code "1" means
-			// we're good and we can take what we've got and roll on.
-			errorResponse := FlickrErrorResponse{}
-			err = xml.Unmarshal(body, &errorResponse)
-			if err != nil {
-
-				logMessage("Could not unmarshal body, check logs for body detail.", true)
-				logMessage(string(body), false)
-				return map[string]Photo{}
-			}
-
-			// The "good" error code
-			if errorResponse.Error.Code == "1" {
-				break
-			}
-
-			logMessage("An error occurred while getting photos for the set. Check the body in the logs.", false)
-			logMessage(string(body), false)
+			logError("Could not unmarshal body, check logs for body detail.", "setId", setId)
+			logDebug("Response body", "setId", setId, "body", string(body))
+			return nil, err
 		}
 
 		for _, v := range responsePhotos {
+			v.Position = len(photos) + 1
 			photos[v.Id] = v
 		}
 
@@ -284,7 +514,7 @@ func getAllPhotos(flickrOAuth FlickrOAuth, apiName string, setId string) map[str
 		currentPage++
 	}
 
-	return photos
+	return photos, nil
 }
 
 /**
@@ -292,32 +522,52 @@ func getAllPhotos(flickrOAuth FlickrOAuth, apiName string, setId string) map[str
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
+ * @param   context.Context    Cancels the request
  * @param   FlickrOAuth        The flickr oauth setup
  * @param   Photo              The flickr media to consider
  * @return  string,string      A photo url and a video url
 **/
 
-func getOriginalSizeUrl(flickrOauth FlickrOAuth, photo Photo) (string, string) {
+func getOriginalSizeUrl(ctx context.Context, flickrOauth FlickrOAuth, photo Photo) (string, string) {
 
 	if photo.Media == "photo" {
 		return photo.OriginalUrl, ""
 	}
 
-	extras := map[string]string{"photo_id": photo.Id}
+	return getSizeUrls(ctx, flickrOauth, photo.Id)
+}
+
+/**
+ * Gets the original photo and video urls for a media id from flickr.photos.getSizes
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context    Cancels the request
+ * @param   FlickrOAuth        The flickr oauth setup
+ * @param   string             The media id
+ * @return  string,string      A photo url and a video url, both empty if the request failed
+**/
+
+func getSizeUrls(ctx context.Context, flickrOauth FlickrOAuth, photoId string) (string, string) {
+
+	extras := map[string]string{"photo_id": photoId}
 
 	var err error
 	var body []byte
 
-	body, err = makeGetRequest(func() string { return generateOAuthUrl(apiBaseUrl, "flickr.photos.getSizes", flickrOauth, extras) })
+	body, err = makeGetRequest(ctx, func() string { return generateOAuthUrl(apiBaseUrl, "flickr.photos.getSizes", flickrOauth, extras) })
 	if err != nil {
-		panic(err)
+		if ctx.Err() == nil {
+			logError(fmt.Sprintf("Could not get the sizes of media Id `%v': %v", photoId, err), "photoId", photoId)
+		}
+		return "", ""
 	}
 
 	response := PhotoSizeResponse{}
 	err = xml.Unmarshal(body, &response)
 	if err != nil {
-		logMessage("Could not unmarshal body, check logs for body detail.", true)
-		logMessage(string(body), false)
+		logError("Could not unmarshal body, check logs for body detail.", "photoId", photoId)
+		logDebug("Response body", "photoId", photoId, "body", string(body))
 		return "", ""
 	}
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -13,6 +14,13 @@ var lastRequestTime time.Time
 
 type UrlFunc func() string
 
+type HttpResponse struct {
+	StatusCode    int
+	ContentType   string
+	ContentLength int64
+	Body          []byte
+}
+
 /**
  * Makes a Http GET request.
  *
@@ -30,11 +38,29 @@ type UrlFunc func() string
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
- * @param   UrlFunc         The function to generate a url for retrying a failed request
- * @return  []byte, error   The byte array of the response and any error
+ * @param   context.Context   Cancels the request
+ * @param   UrlFunc           The function to generate a url for retrying a failed request
+ * @return  []byte, error     The byte array of the response and any error
 **/
 
-func makeGetRequest(generateUrlFunction UrlFunc) ([]byte, error) {
+func makeGetRequest(ctx context.Context, generateUrlFunction UrlFunc) ([]byte, error) {
+
+	response, err := makeRequest(ctx, generateUrlFunction)
+	return response.Body, err
+}
+
+/**
+ * Does the work for makeGetRequest, and also returns the parts of the
+ * response we need to validate downloads.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context        Cancels the request
+ * @param   UrlFunc                The function to generate a url for retrying a failed request
+ * @return  HttpResponse, error    The response and any error
+**/
+
+func makeRequest(ctx context.Context, generateUrlFunction UrlFunc) (HttpResponse, error) {
 
 	currentTime := time.Now()
 	if !lastRequestTime.IsZero() {
@@ -44,8 +70,10 @@ func makeGetRequest(generateUrlFunction UrlFunc) ([]byte, error) {
 		milli := nano * 1000000
 
 		if milli < 1000 && milli > 0 {
-			logMessage(fmt.Sprintf("Sleeping for %v milliseconds before making another request.", milli), false)
-			time.Sleep(milli * time.Millisecond)
+			logDebug(fmt.Sprintf("Sleeping for %v milliseconds before making another request.", milli))
+			if err := sleepContext(ctx, milli*time.Millisecond); err != nil {
+				return HttpResponse{}, err
+			}
 		}
 	}
 
@@ -58,24 +86,60 @@ func makeGetRequest(generateUrlFunction UrlFunc) ([]byte, error) {
 		var err error
 
 		url := generateUrlFunction()
-		resp, err = http.Get(url)
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 		if err != nil {
-			return []byte{}, err
+			return HttpResponse{}, err
+		}
+
+		resp, err = http.DefaultClient.Do(request)
+		if err != nil {
+			return HttpResponse{}, err
 		}
 
 		var body []byte
 		body, err = ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
 		if err != nil {
-			return []byte{}, err
+			return HttpResponse{}, err
 		}
 
 		if strings.Contains(string(body), "oauth_problem=signature_invalid") && retryCount < 10 {
 			retryCount++
-			logMessage("Sleeping and retrying request, retry #"+strconv.Itoa(retryCount)+". Url: `"+url+"'", false)
-			time.Sleep(1 * time.Second)
+			logDebug("Sleeping and retrying request, retry #" + strconv.Itoa(retryCount) + ". Url: `" + url + "'")
+			if err := sleepContext(ctx, 1*time.Second); err != nil {
+				return HttpResponse{}, err
+			}
 		} else {
-			return body, nil
+			response := HttpResponse{
+				StatusCode:    resp.StatusCode,
+				ContentType:   resp.Header.Get("Content-Type"),
+				ContentLength: resp.ContentLength,
+				Body:          body,
+			}
+			return response, nil
 		}
 	}
 }
+
+/**
+ * Sleeps, unless the context is cancelled first
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context   Cuts the sleep short
+ * @param   time.Duration     How long to sleep
+ * @return  error             The context's error if it was cancelled
+**/
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 var perms os.FileMode = 0700
+var trashDirName = ".trash"
+var trashBatch = ""
+
+// Downloads are written to <file>.part and renamed when they are complete
+var partialFileSuffix = ".part"
 
 /**
  * Determines if a file exists on disk
@@ -31,28 +40,86 @@ func pathExists(fullPath string) bool {
 }
 
 /**
- * Given a UrlFunc and file path, save the contents of the url to the file location
+ * Given a UrlFunc and file path, save the contents of the url to the file location.
+ * The file is written under a temporary name and renamed once it is complete, so
+ * an interrupted download never leaves half a file at the full path.
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
- * @param   UrlFunc    The function to generate the url
- * @param   string     The full path to save the contents to
- * @return  void
+ * @param   context.Context   Cancels the download
+ * @param   UrlFunc           The function to generate the url
+ * @param   string            The full path to save the contents to
+ * @return  FileChecksum, error   The checksum of the saved file and any error
 **/
 
-func saveUrlToFile(urlGenerator UrlFunc, fullPath string) {
+func saveUrlToFile(ctx context.Context, urlGenerator UrlFunc, fullPath string) (FileChecksum, error) {
 
 	var err error
-	var body []byte
+	var response HttpResponse
+
+	for attempt := 1; attempt <= downloadAttempts; attempt++ {
+
+		response, err = makeRequest(ctx, urlGenerator)
+		if ctx.Err() != nil {
+			return FileChecksum{}, ctx.Err()
+		}
+		if err != nil {
+			url := urlGenerator()
+			logError(fmt.Sprintf("Could not download file at url. Skipping file. Url: '%v'. Error: '%v'.", url, err.Error()), "path", fullPath)
+			return FileChecksum{}, err
+		}
+
+		// Don't save html error pages and the like as media, we'd consider them downloaded forever
+		err = validateMediaResponse(response, fullPath)
+		if err == nil {
+			break
+		}
+
+		logWarn(fmt.Sprintf("Download of `%v' was not valid media, attempt %v of %v. Error: '%v'.", fullPath, attempt, downloadAttempts, err.Error()), "path", fullPath)
+		if attempt < downloadAttempts {
+			if err := sleepContext(ctx, time.Duration(attempt)*time.Second); err != nil {
+				return FileChecksum{}, err
+			}
+		}
+	}
 
-	body, err = makeGetRequest(urlGenerator)
 	if err != nil {
 		url := urlGenerator()
-		logMessage(fmt.Sprintf("Could not download file at url. Skipping file. Url: '%v'. Error: '%v'.", url, err.Error()), true)
-		return
+		logError(fmt.Sprintf("Could not download valid media at url. Skipping file. Url: '%v'. Error: '%v'.", url, err.Error()), "path", fullPath)
+		return FileChecksum{}, err
+	}
+
+	partialPath := fullPath + partialFileSuffix
+	err = ioutil.WriteFile(partialPath, response.Body, 0644)
+	if err == nil {
+		err = os.Rename(partialPath, fullPath)
+	}
+	if err != nil {
+		os.Remove(partialPath)
+		logError(fmt.Sprintf("Could not write file `%v'. Error: '%v'.", fullPath, err.Error()), "path", fullPath)
+		return FileChecksum{}, err
 	}
 
-	err = ioutil.WriteFile(fullPath, body, 0644)
+	return hashBytes(response.Body), nil
+}
+
+/**
+ * Removes the partial files left behind by downloads that didn't finish, e.g.
+ * because fsync was killed
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string   The directory to clean up
+ * @return  void
+**/
+
+func removePartialFiles(dir string) {
+
+	partials, _ := filepath.Glob(filepath.Join(dir, "*"+partialFileSuffix))
+	for _, path := range partials {
+		logDebug(fmt.Sprintf("Removing the partial download `%v'.", path), "path", path)
+		os.Remove(path)
+	}
 }
 
 /**
@@ -87,6 +154,75 @@ func deleteFile(fullPath string) {
 	os.Remove(fullPath)
 }
 
+/**
+ * Reads a json file into the given value, if the file exists
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string        The full path to the file
+ * @param   interface{}   The value to unmarshal into
+ * @return  bool          Whether the file existed and could be parsed
+**/
+
+func readJsonFile(fullPath string, v interface{}) bool {
+
+	if !pathExists(fullPath) {
+		return false
+	}
+
+	fileContents, err := ioutil.ReadFile(fullPath)
+	if err != nil || len(fileContents) == 0 {
+		return false
+	}
+
+	return json.Unmarshal(fileContents, v) == nil
+}
+
+/**
+ * Moves a file into the trash directory under the root directory instead of
+ * deleting it. Files trashed during one run share a timestamped directory and
+ * keep their path relative to the root directory.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string          The full path of the file to trash
+ * @return  string, error   The path the file was moved to and any error
+**/
+
+func trashFile(fullPath string) (string, error) {
+
+	if trashBatch == "" {
+		trashBatch = time.Now().Format("20060102-150405")
+	}
+
+	relativePath, err := filepath.Rel(*rootDirectory, fullPath)
+	if err != nil || strings.HasPrefix(relativePath, "..") {
+		relativePath = filepath.Base(fullPath)
+	}
+
+	trashPath := filepath.Join(*rootDirectory, trashDirName, trashBatch, relativePath)
+	err = os.MkdirAll(filepath.Dir(trashPath), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	return trashPath, os.Rename(fullPath, trashPath)
+}
+
+/**
+ * Determines if a directory is fsync's trash, which directory walks should skip
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   os.FileInfo   The directory
+ * @return  bool
+**/
+
+func isTrashDir(f os.FileInfo) bool {
+
+	return f.IsDir() && f.Name() == trashDirName
+}
+
 func getUserFilePath(fileName string) string {
 
 	dir := ensureUserHomeDir()
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var dupesLink = new(bool)
+var dupesDryRun = new(bool)
+var useReflinks = new(bool)
+
+type LinkResult struct {
+	Path   string `json:"path"`
+	Target string `json:"target"`
+	Bytes  int64  `json:"bytes"`
+	Error  string `json:"error,omitempty"`
+}
+
+/**
+ * Replaces byte-identical copies of media with hardlinks (or reflinks) to a
+ * single copy, so duplicates across sets stop using disk space. Contents are
+ * compared byte for byte before anything is replaced.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  bool   Whether every link was made
+**/
+
+func linkDuplicates() bool {
+
+	results := []LinkResult{}
+	var reclaimed int64 = 0
+	failed := 0
+	setMetadata := map[string]SetMetadata{}
+
+	for _, group := range findContentDuplicateGroups() {
+
+		// Keep a copy fsync knows about, if there is one
+		targetIndex := 0
+		for i, file := range group.Files {
+			if file.MediaId != "" {
+				targetIndex = i
+				break
+			}
+		}
+
+		target := group.Files[targetIndex]
+		targetInfo, err := os.Stat(target.Path)
+		if err != nil {
+			continue
+		}
+
+		for i, file := range group.Files {
+
+			if i == targetIndex {
+				continue
+			}
+
+			info, err := os.Stat(file.Path)
+			if err != nil {
+				continue
+			}
+
+			// Already linked, there's nothing to reclaim
+			if os.SameFile(targetInfo, info) {
+				continue
+			}
+
+			result := LinkResult{Path: file.Path, Target: target.Path, Bytes: group.Size}
+
+			err = linkIdenticalFile(target.Path, file.Path)
+			if err != nil {
+				result.Error = err.Error()
+				failed++
+				logError(fmt.Sprintf("Could not link `%v' to `%v': %v", file.Path, target.Path, err), "photoId", file.MediaId)
+			} else {
+				reclaimed += group.Size
+				if !*dupesDryRun {
+					recordChecksum(file, group, setMetadata)
+					recordChecksum(target, group, setMetadata)
+				}
+				if !isJsonOutput() {
+					verb := "Linked"
+					if *dupesDryRun {
+						verb = "Would link"
+					}
+					printLine(fmt.Sprintf("%v `%v' to `%v' (%v bytes).", verb, file.Path, target.Path, group.Size))
+				}
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	if isJsonOutput() {
+		printJson(struct {
+			DryRun         bool         `json:"dryRun"`
+			Links          []LinkResult `json:"links"`
+			ReclaimedBytes int64        `json:"reclaimedBytes"`
+			Failed         int          `json:"failed"`
+		}{*dupesDryRun, results, reclaimed, failed})
+	} else if *dupesDryRun {
+		printLine(fmt.Sprintf("%v files could be linked, reclaiming %v bytes.", len(results)-failed, reclaimed))
+	} else {
+		printLine(fmt.Sprintf("Linked %v files, reclaiming %v bytes. %v files could not be linked.", len(results)-failed, reclaimed, failed))
+	}
+
+	return failed == 0
+}
+
+/**
+ * Replaces a file with a link to an identical file, after checking they
+ * really are identical. The link is made next to the file first and renamed
+ * over it, so the file is never missing.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string   The file to keep
+ * @param   string   The file to replace with a link
+ * @return  error
+**/
+
+func linkIdenticalFile(target string, fullPath string) error {
+
+	same, err := filesHaveSameContents(target, fullPath)
+	if err != nil {
+		return err
+	}
+
+	if !same {
+		return errors.New("the contents changed since they were hashed")
+	}
+
+	if *dupesDryRun {
+		return nil
+	}
+
+	tempPath := fullPath + ".fsync-link"
+	os.Remove(tempPath)
+
+	if *useReflinks {
+		err = reflinkFile(target, tempPath)
+	} else {
+		err = os.Link(target, tempPath)
+	}
+
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	err = os.Rename(tempPath, fullPath)
+	if err != nil {
+		os.Remove(tempPath)
+	}
+
+	return err
+}
+
+/**
+ * Compares two files byte for byte
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string
+ * @param   string
+ * @return  bool, error
+**/
+
+func filesHaveSameContents(first string, second string) (bool, error) {
+
+	f1, err := os.Open(first)
+	if err != nil {
+		return false, err
+	}
+	defer f1.Close()
+
+	f2, err := os.Open(second)
+	if err != nil {
+		return false, err
+	}
+	defer f2.Close()
+
+	buf1 := make([]byte, 64*1024)
+	buf2 := make([]byte, 64*1024)
+	for {
+		n1, err1 := io.ReadFull(f1, buf1)
+		n2, err2 := io.ReadFull(f2, buf2)
+
+		if n1 != n2 || !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false, nil
+		}
+
+		if err1 == io.EOF || err1 == io.ErrUnexpectedEOF {
+			return err2 == io.EOF || err2 == io.ErrUnexpectedEOF, nil
+		}
+
+		if err1 != nil {
+			return false, err1
+		}
+
+		if err2 != nil {
+			return false, err2
+		}
+	}
+}
+
+/**
+ * Records the checksum of a linked file in its set's metadata
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   DuplicateFile            The file
+ * @param   ContentDuplicateGroup    The group it is in
+ * @param   map[string]SetMetadata   Metadata already loaded, indexed by directory
+ * @return  void
+**/
+
+func recordChecksum(file DuplicateFile, group ContentDuplicateGroup, setMetadata map[string]SetMetadata) {
+
+	if file.MediaId == "" {
+		return
+	}
+
+	dir := filepath.Dir(file.Path)
+	metadata, ok := setMetadata[dir]
+	if !ok {
+		metadata, _ = loadSetMetadata(dir)
+	}
+
+	for _, pm := range metadata.Photos {
+		if pm.PhotoId != file.MediaId {
+			continue
+		}
+
+		// Files with the metadata written into them keep the checksum of the
+		// download, so only the embedded one is recorded
+		if pm.EmbeddedSha256 != "" && pm.EmbeddedSha256 != group.Sha256 {
+			pm.EmbeddedSha256 = group.Sha256
+			pm.EmbeddedSize = group.Size
+			metadata.AddOrUpdate(pm, filepath.Join(dir, setMetadataFileName))
+		} else if pm.EmbeddedSha256 == "" && pm.Sha256 != group.Sha256 {
+			pm.Sha256 = group.Sha256
+			pm.Size = group.Size
+			metadata.AddOrUpdate(pm, filepath.Join(dir, setMetadataFileName))
+		}
+		break
+	}
+
+	setMetadata[dir] = metadata
+}
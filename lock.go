@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var lockWait = new(time.Duration)
+
+var dirLockFileName = ".fsync.lock"
+var defaultProfile = "default"
+
+// Who holds a lock
+type LockOwner struct {
+	Pid       int       `json:"pid"`
+	Hostname  string    `json:"hostname"`
+	Command   string    `json:"command"`
+	Directory string    `json:"directory"`
+	Started   time.Time `json:"started"`
+}
+
+// Another fsync holds a lock we need
+type lockHeldError struct {
+	path  string
+	owner LockOwner
+}
+
+func (e *lockHeldError) Error() string {
+
+	message := fmt.Sprintf("Another fsync (%v, pid %v on %v, started %v) holds the lock `%v'.",
+		e.owner.Command, e.owner.Pid, e.owner.Hostname, e.owner.Started.Local().Format(time.RFC1123), e.path)
+	if *lockWait == 0 {
+		message += " Use -wait to wait for it to finish."
+	}
+
+	return message
+}
+
+/**
+ * Takes the locks that stop two fsyncs changing the same files at once: one in
+ * the root directory, and one in ~/.fsync for the profile, since the profile's
+ * credentials and status are shared too. With -wait, locks held by another
+ * fsync are retried until the wait is over. Locks left behind by an fsync that
+ * is no longer running are taken over.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string             The command taking the locks
+ * @return  []string, error    The lock files taken, to pass to releaseLocks
+**/
+
+func acquireLocks(command string) ([]string, error) {
+
+	owner := LockOwner{Pid: os.Getpid(), Command: command, Directory: *rootDirectory, Started: time.Now()}
+	owner.Hostname, _ = os.Hostname()
+
+	paths := []string{filepath.Join(ensureUserHomeDir(), profileName()+".lock")}
+	if *rootDirectory != "" {
+		if err := os.MkdirAll(*rootDirectory, 0755); err != nil {
+			return nil, err
+		}
+		paths = append(paths, filepath.Join(*rootDirectory, dirLockFileName))
+	}
+
+	deadline := time.Now().Add(*lockWait)
+	taken := []string{}
+	for _, path := range paths {
+		waiting := false
+		for {
+			err := createLockFile(path, owner)
+			if err == nil {
+				taken = append(taken, path)
+				break
+			}
+
+			held, ok := err.(*lockHeldError)
+			if !ok || time.Now().After(deadline) {
+				releaseLocks(taken)
+				return nil, err
+			}
+
+			if !waiting {
+				logInfo(fmt.Sprintf("Waiting up to %v for another fsync (%v, pid %v on %v) to finish.", *lockWait, held.owner.Command, held.owner.Pid, held.owner.Hostname))
+				waiting = true
+			}
+			time.Sleep(time.Second)
+		}
+	}
+
+	return taken, nil
+}
+
+/**
+ * Creates a lock file, unless another fsync that is still running holds it.
+ * The file is written under another name and hard linked into place, so it is
+ * never seen half written and is never replaced. A stale lock is moved out of
+ * the way under a name only we use before it is removed, so that two fsyncs
+ * taking it over at once can't remove the other's new lock.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string      The lock file
+ * @param   LockOwner   Who is taking the lock
+ * @return  error       A *lockHeldError if another fsync holds it
+**/
+
+func createLockFile(path string, owner LockOwner) error {
+
+	b, err := json.MarshalIndent(owner, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempPath := fmt.Sprintf("%v.%v.tmp", path, owner.Pid)
+	if err := ioutil.WriteFile(tempPath, b, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+
+	for {
+		err := placeLockFile(tempPath, path, b)
+		if err == nil {
+			return confirmLockOwner(path, owner)
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		existing := LockOwner{}
+		if readJsonFile(path, &existing) {
+			if !lockIsStale(existing) {
+				return &lockHeldError{path: path, owner: existing}
+			}
+		} else if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < time.Minute {
+			// It may be being written right now, by an fsync without hard links
+			return &lockHeldError{path: path, owner: LockOwner{Command: "unknown", Started: info.ModTime()}}
+		}
+
+		stalePath := fmt.Sprintf("%v.%v.stale", path, owner.Pid)
+		if err := os.Rename(path, stalePath); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		// If another fsync took the lock over first, we moved their lock, so it goes back
+		moved := LockOwner{}
+		readJsonFile(stalePath, &moved)
+		if !sameLockOwner(moved, existing) {
+			if os.Link(stalePath, path) != nil && !pathExists(path) {
+				os.Rename(stalePath, path)
+			}
+			os.Remove(stalePath)
+			return &lockHeldError{path: path, owner: moved}
+		}
+
+		os.Remove(stalePath)
+		if existing.Pid != 0 {
+			logWarn(fmt.Sprintf("Taking over the lock `%v' from pid %v, which is no longer running.", path, existing.Pid))
+		}
+	}
+}
+
+func placeLockFile(tempPath string, path string, b []byte) error {
+
+	err := os.Link(tempPath, path)
+	if err == nil || os.IsExist(err) {
+		return err
+	}
+	if pathExists(path) {
+		return os.ErrExist
+	}
+
+	// Some filesystems, e.g. FAT, have no hard links
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(b)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+
+	return err
+}
+
+func confirmLockOwner(path string, owner LockOwner) error {
+
+	current := LockOwner{}
+	if !readJsonFile(path, &current) || !sameLockOwner(current, owner) {
+		return &lockHeldError{path: path, owner: current}
+	}
+
+	return nil
+}
+
+func sameLockOwner(a LockOwner, b LockOwner) bool {
+
+	return a.Pid == b.Pid && a.Hostname == b.Hostname && a.Started.Equal(b.Started)
+}
+
+/**
+ * Determines if a lock was left behind by an fsync that is no longer running.
+ * Locks taken on other hosts, e.g. for a directory on a network share, can't
+ * be checked, so they are never stale.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   LockOwner   Who holds the lock
+ * @return  bool
+**/
+
+func lockIsStale(owner LockOwner) bool {
+
+	hostname, _ := os.Hostname()
+	if owner.Hostname != hostname {
+		return false
+	}
+
+	return owner.Pid != os.Getpid() && !processIsRunning(owner.Pid)
+}
+
+/**
+ * Removes the lock files we took
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   []string   The lock files
+ * @return  void
+**/
+
+func releaseLocks(paths []string) {
+
+	for _, path := range paths {
+		// Leave it alone if it was taken over from us
+		owner := LockOwner{}
+		if readJsonFile(path, &owner) && owner.Pid != os.Getpid() {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logWarn(fmt.Sprintf("Could not remove the lock `%v': %v", path, err))
+		}
+	}
+}
+
+/**
+ * Gets the name of the profile, which is the name of the config file without
+ * its extension, e.g. "work" for -config ~/.fsync/work.json
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  string
+**/
+
+func profileName() string {
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv(configFileEnvVar)
+	}
+	if path == "" || filepath.Base(path) == configFileName {
+		return defaultProfile
+	}
+
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
@@ -1,61 +1,324 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
-	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 )
 
+var verbose = new(bool)
+var quiet = new(bool)
+var logDirectory = new(string)
+var logFormat = new(string)
+var logLevel = new(string)
+var logMaxSize = new(int)
+var logMaxAge = new(int)
+
+// Serializes everything written to the console, so log lines and progress don't interleave
+var consoleMutex sync.Mutex
+
+/**
+ * Checks the logging flags have values we understand
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  error
+**/
+
+func validateLogFlags() error {
+
+	if *verbose && *quiet {
+		return fmt.Errorf("-v and -q can't be used together")
+	}
+
+	if *logFormat != "text" && *logFormat != "json" {
+		return fmt.Errorf("unknown -logFormat `%v', use text or json", *logFormat)
+	}
+
+	if _, err := parseLogLevel(*logLevel); err != nil {
+		return err
+	}
+
+	if *logMaxSize <= 0 || *logMaxAge <= 0 {
+		return fmt.Errorf("-logMaxSize and -logMaxAge must be greater than zero")
+	}
+
+	return nil
+}
+
 /**
- * Sets up the global logger for the app
+ * Sets up the global logger for the app. Everything at -logLevel and above goes to
+ * the log file, and info and above (debug with -v, warnings and errors with -q)
+ * is echoed to the console.
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
- * @return  Logger
+ * @return  *slog.Logger
 **/
 
-func createLogger() *log.Logger {
+func createLogger() *slog.Logger {
 
-	t := time.Now()
-	format := "20060102"
+	dir := *logDirectory
+	if dir == "" {
+		dir = filepath.Join(ensureUserHomeDir(), "logs")
+	}
 
-	filePart := t.Format(format)
+	err := os.MkdirAll(dir, perms)
+	if err != nil {
+		panic(err)
+	}
 
-	logDir := ensureUserHomeDir()
-	logDir = path.Join(logDir, "logs")
-	err := os.MkdirAll(logDir, perms)
+	removeOldLogs(dir, time.Duration(*logMaxAge)*24*time.Hour)
+
+	file, err := openRotatingLog(dir, int64(*logMaxSize)*1024*1024)
 	if err != nil {
 		panic(err)
 	}
 
-	filePath := path.Join(logDir, "fsync-"+filePart+".log")
-	var fi *os.File
-	if !pathExists(filePath) {
-		fi, _ = os.Create(filePath)
+	fileLevel, _ := parseLogLevel(*logLevel)
+	options := &slog.HandlerOptions{
+		AddSource: true,
+		Level:     fileLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// Just the file name and line, the whole path is noise
+			if source, ok := a.Value.Any().(*slog.Source); ok && a.Key == slog.SourceKey {
+				return slog.String(slog.SourceKey, fmt.Sprintf("%v:%v", filepath.Base(source.File), source.Line))
+			}
+			return a
+		},
+	}
+
+	var fileHandler slog.Handler
+	if *logFormat == "json" {
+		fileHandler = slog.NewJSONHandler(file, options)
 	} else {
-		fi, _ = os.OpenFile(filePath, os.O_RDWR|os.O_APPEND, 0755)
+		fileHandler = slog.NewTextHandler(file, options)
 	}
 
-	l := log.New(fi, "", log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile)
-	return l
+	consoleLevel := slog.LevelInfo
+	if *verbose {
+		consoleLevel = slog.LevelDebug
+	} else if *quiet {
+		consoleLevel = slog.LevelWarn
+	}
+
+	return slog.New(teeHandler{fileHandler, &consoleHandler{level: consoleLevel}})
+}
+
+/**
+ * Parses a log level name
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string              debug, info, warn or error
+ * @return  slog.Level, error
+**/
+
+func parseLogLevel(name string) (slog.Level, error) {
+
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+
+	return slog.LevelInfo, fmt.Errorf("unknown -logLevel `%v', use debug, info, warn or error", name)
+}
+
+/**
+ * Logs details that are only interesting when something goes wrong. Fields are
+ * key value pairs added to the message, e.g. "setId", set.Id
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string   The message to log
+ * @param   ...any   Key value pairs of contextual fields
+ * @return  void
+**/
+
+func logDebug(message string, fields ...any) {
+
+	writeLog(slog.LevelDebug, message, fields)
+}
+
+/**
+ * Logs what fsync is doing
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string   The message to log
+ * @param   ...any   Key value pairs of contextual fields
+ * @return  void
+**/
+
+func logInfo(message string, fields ...any) {
+
+	writeLog(slog.LevelInfo, message, fields)
 }
 
 /**
- * Logs a message to the log file and optionally echos the message to stdout
+ * Logs a problem fsync can carry on from
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
  * @param   string   The message to log
- * @param   bool     Determines if we should echo the message as well
+ * @param   ...any   Key value pairs of contextual fields
  * @return  void
 **/
 
-func logMessage(message string, echo bool) {
+func logWarn(message string, fields ...any) {
+
+	writeLog(slog.LevelWarn, message, fields)
+}
+
+/**
+ * Logs a failure
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string   The message to log
+ * @param   ...any   Key value pairs of contextual fields
+ * @return  void
+**/
+
+func logError(message string, fields ...any) {
+
+	writeLog(slog.LevelError, message, fields)
+}
+
+func writeLog(level slog.Level, message string, fields []any) {
+
+	// Nothing is set up yet, e.g. while parsing the command line
+	if Flogger == nil {
+		if level >= slog.LevelInfo {
+			fmt.Fprintln(os.Stderr, message)
+		}
+		return
+	}
+
+	ctx := context.Background()
+	if !Flogger.Enabled(ctx, level) {
+		return
+	}
+
+	// Report where the message was logged from, not this function
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+
+	record := slog.NewRecord(time.Now(), level, message, pcs[0])
+	record.Add(fields...)
+	Flogger.Handler().Handle(ctx, record)
+}
+
+// Sends records to every handler that wants them
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, record slog.Record) error {
 
-	Flogger.Println(message)
-	if echo {
-		fmt.Println(message)
+	var err error
+	for _, h := range t {
+		if h.Enabled(ctx, record.Level) {
+			if e := h.Handle(ctx, record.Clone()); e != nil {
+				err = e
+			}
+		}
 	}
+
+	return err
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+
+	handlers := teeHandler{}
+	for _, h := range t {
+		handlers = append(handlers, h.WithAttrs(attrs))
+	}
+
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+
+	handlers := teeHandler{}
+	for _, h := range t {
+		handlers = append(handlers, h.WithGroup(name))
+	}
+
+	return handlers
+}
+
+// Prints messages to the console the way people read them: just the message,
+// with the fields only in verbose mode. Warnings and errors go to stderr, as
+// does everything when stdout is reserved for json results.
+type consoleHandler struct {
+	level slog.Level
+	attrs []slog.Attr
+}
+
+func (h *consoleHandler) Enabled(ctx context.Context, level slog.Level) bool {
+
+	return level >= h.level
+}
+
+func (h *consoleHandler) Handle(ctx context.Context, record slog.Record) error {
+
+	line := record.Message
+	if *verbose {
+		fields := []string{}
+		addField := func(a slog.Attr) bool {
+			fields = append(fields, fmt.Sprintf("%v=%v", a.Key, a.Value))
+			return true
+		}
+		for _, a := range h.attrs {
+			addField(a)
+		}
+		record.Attrs(addField)
+		if len(fields) > 0 {
+			line += " (" + strings.Join(fields, " ") + ")"
+		}
+	}
+
+	out := os.Stdout
+	if isJsonOutput() || record.Level >= slog.LevelWarn {
+		out = os.Stderr
+	}
+
+	consoleMutex.Lock()
+	defer consoleMutex.Unlock()
+	hideProgress()
+	_, err := fmt.Fprintln(out, line)
+	showProgress()
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+
+	return &consoleHandler{level: h.level, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+
+	return h
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var logFileName = "fsync.log"
+
+// The log file, which is moved aside to fsync-<date>-<time>.log when it
+// gets too big or a new day starts
+type rotatingLog struct {
+	mutex   sync.Mutex
+	dir     string
+	maxSize int64
+	file    *os.File
+	size    int64
+	opened  time.Time
+}
+
+/**
+ * Opens the log file in a directory for appending, rotating it first if it is
+ * from a previous day or already too big
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string               The log directory
+ * @param   int64                The size in bytes to rotate at
+ * @return  *rotatingLog, error
+**/
+
+func openRotatingLog(dir string, maxSize int64) (*rotatingLog, error) {
+
+	l := &rotatingLog{dir: dir, maxSize: maxSize}
+
+	if info, err := os.Stat(filepath.Join(dir, logFileName)); err == nil {
+		if info.Size() >= maxSize || !sameDay(info.ModTime(), time.Now()) {
+			if err := l.moveAside(info.ModTime()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return l, l.open()
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.size > 0 && (l.size+int64(len(p)) > l.maxSize || !sameDay(l.opened, time.Now())) {
+		l.file.Close()
+		if err := l.moveAside(time.Now()); err != nil {
+			return 0, err
+		}
+		if err := l.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+func (l *rotatingLog) open() error {
+
+	file, err := os.OpenFile(filepath.Join(l.dir, logFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+func (l *rotatingLog) moveAside(t time.Time) error {
+
+	rotated := filepath.Join(l.dir, "fsync-"+t.Format("20060102-150405")+".log")
+	for i := 1; pathExists(rotated); i++ {
+		rotated = filepath.Join(l.dir, fmt.Sprintf("fsync-%v-%v.log", t.Format("20060102-150405"), i))
+	}
+
+	return os.Rename(filepath.Join(l.dir, logFileName), rotated)
+}
+
+/**
+ * Deletes rotated log files older than the given age
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string          The log directory
+ * @param   time.Duration   How long to keep rotated logs
+ * @return  void
+**/
+
+func removeOldLogs(dir string, maxAge time.Duration) {
+
+	rotated, _ := filepath.Glob(filepath.Join(dir, "fsync-*.log"))
+	for _, path := range rotated {
+		info, err := os.Stat(path)
+		if err == nil && time.Since(info.ModTime()) > maxAge {
+			os.Remove(path)
+		}
+	}
+}
+
+func sameDay(a time.Time, b time.Time) bool {
+
+	return a.Format("20060102") == b.Format("20060102")
+}
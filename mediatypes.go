@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var photoKind = "photo"
+var videoKind = "video"
+
+// How many bytes detectMediaType needs to look at, enough for the second
+// packet of an M2TS file
+var mediaHeaderLength = 200
+
+type MediaType struct {
+	Name       string
+	Kind       string
+	Extensions []string
+
+	// Whether the standard library can decode it, for -decodeImages and dupes -similar
+	Decodable bool
+
+	// Recognizes the type from the start of a file
+	Magic func(header []byte) bool
+}
+
+// Every type of media Flickr serves that we know about. Detection by magic
+// bytes checks these in order, so more specific types come first.
+var mediaTypes = []*MediaType{
+	&MediaType{Name: "jpeg", Kind: photoKind, Extensions: []string{".jpg", ".jpeg", ".jpe"}, Decodable: true,
+		Magic: func(h []byte) bool { return bytes.HasPrefix(h, []byte{0xFF, 0xD8, 0xFF}) }},
+	&MediaType{Name: "png", Kind: photoKind, Extensions: []string{".png"}, Decodable: true,
+		Magic: func(h []byte) bool { return bytes.HasPrefix(h, []byte("\x89PNG\r\n\x1a\n")) }},
+	&MediaType{Name: "gif", Kind: photoKind, Extensions: []string{".gif"}, Decodable: true,
+		Magic: func(h []byte) bool {
+			return bytes.HasPrefix(h, []byte("GIF87a")) || bytes.HasPrefix(h, []byte("GIF89a"))
+		}},
+	&MediaType{Name: "webp", Kind: photoKind, Extensions: []string{".webp"},
+		Magic: func(h []byte) bool { return riffType(h) == "WEBP" }},
+	&MediaType{Name: "heic", Kind: photoKind, Extensions: []string{".heic", ".heif"},
+		Magic: func(h []byte) bool { return hasFtypBrand(h, "heic", "heix", "heim", "heis", "hevc", "mif1", "msf1") }},
+	&MediaType{Name: "tiff", Kind: photoKind, Extensions: []string{".tif", ".tiff"},
+		Magic: func(h []byte) bool {
+			return bytes.HasPrefix(h, []byte("II*\x00")) || bytes.HasPrefix(h, []byte("MM\x00*"))
+		}},
+	&MediaType{Name: "bmp", Kind: photoKind, Extensions: []string{".bmp"},
+		Magic: func(h []byte) bool {
+			// "BM" alone is too common in text, so also check the reserved header bytes are zero
+			return len(h) >= 10 && bytes.HasPrefix(h, []byte("BM")) && bytes.Equal(h[6:10], []byte{0, 0, 0, 0})
+		}},
+	&MediaType{Name: "mov", Kind: videoKind, Extensions: []string{".mov", ".qt"},
+		Magic: func(h []byte) bool {
+			return hasFtypBrand(h, "qt  ") || hasAtom(h, "moov", "mdat", "wide", "free", "skip", "pnot")
+		}},
+	&MediaType{Name: "mp4", Kind: videoKind, Extensions: []string{".mp4", ".m4v"},
+		Magic: func(h []byte) bool { return hasAtom(h, "ftyp") && !hasFtypBrand(h, "3gp4", "3gp5", "3gp6", "3g2a") }},
+	&MediaType{Name: "3gp", Kind: videoKind, Extensions: []string{".3gp", ".3g2"},
+		Magic: func(h []byte) bool { return hasFtypBrand(h, "3gp4", "3gp5", "3gp6", "3g2a") }},
+	&MediaType{Name: "avi", Kind: videoKind, Extensions: []string{".avi"},
+		Magic: func(h []byte) bool { return riffType(h) == "AVI " }},
+	&MediaType{Name: "mpeg", Kind: videoKind, Extensions: []string{".mpg", ".mpeg"},
+		Magic: func(h []byte) bool { return bytes.HasPrefix(h, []byte{0x00, 0x00, 0x01, 0xBA}) }},
+	&MediaType{Name: "mpegts", Kind: videoKind, Extensions: []string{".mts", ".m2ts"},
+		Magic: func(h []byte) bool {
+			// 188 byte packets starting with a sync byte, and in M2TS 192 byte packets
+			// with a timestamp before the sync byte. One sync byte alone is too common.
+			return hasSyncBytes(h, 0, 188) || hasSyncBytes(h, 4, 192)
+		}},
+	&MediaType{Name: "wmv", Kind: videoKind, Extensions: []string{".wmv", ".asf"},
+		Magic: func(h []byte) bool {
+			return bytes.HasPrefix(h, []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11})
+		}},
+	&MediaType{Name: "ogg", Kind: videoKind, Extensions: []string{".ogv", ".ogg"},
+		Magic: func(h []byte) bool { return bytes.HasPrefix(h, []byte("OggS")) }},
+}
+
+/**
+ * Finds the media type for a file name by its extension
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string       The file name or path
+ * @return  *MediaType   The type, or nil if the extension isn't media
+**/
+
+func mediaTypeForFile(fileName string) *MediaType {
+
+	extension := strings.ToLower(filepath.Ext(fileName))
+	if extension == "" {
+		return nil
+	}
+
+	for _, mediaType := range mediaTypes {
+		for _, e := range mediaType.Extensions {
+			if e == extension {
+				return mediaType
+			}
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Detects the media type from the magic bytes at the start of the contents
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   []byte       The contents, or at least the first mediaHeaderLength bytes
+ * @return  *MediaType   The type, or nil if it doesn't look like media
+**/
+
+func detectMediaType(header []byte) *MediaType {
+
+	for _, mediaType := range mediaTypes {
+		if mediaType.Magic(header) {
+			return mediaType
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Determines the media type of a file on disk: by extension, or by magic
+ * bytes for files whose extension we don't recognize.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string       The full path
+ * @return  *MediaType   The type, or nil if it isn't media
+**/
+
+func mediaTypeOfPath(fullPath string) *MediaType {
+
+	if mediaType := mediaTypeForFile(fullPath); mediaType != nil {
+		return mediaType
+	}
+
+	// Our own files are never media
+	name := filepath.Base(fullPath)
+	if name == setMetadataFileName || strings.HasPrefix(name, ".") || strings.HasSuffix(name, partialFileSuffix) {
+		return nil
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	header := make([]byte, mediaHeaderLength)
+	n, err := io.ReadFull(f, header)
+	if n == 0 {
+		return nil
+	}
+
+	return detectMediaType(header[:n])
+}
+
+/**
+ * Determines if two media types are the same kind of content. Videos are
+ * interchangeable, since Flickr serves some MP4s that we save as .mov
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   *MediaType
+ * @param   *MediaType
+ * @return  bool
+**/
+
+func mediaTypesCompatible(first *MediaType, second *MediaType) bool {
+
+	return first == second || (first.Kind == videoKind && second.Kind == videoKind)
+}
+
+/**
+ * Walks every media file under the root directory, skipping the trash
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   func(string, os.FileInfo, *MediaType)   Called with the path, file info and type of each media file
+ * @return  void
+**/
+
+func walkMediaFiles(visit func(path string, f os.FileInfo, mediaType *MediaType)) {
+
+	visitor := func(path string, f os.FileInfo, err error) error {
+
+		if err != nil {
+			return nil
+		}
+
+		if isTrashDir(f) {
+			return filepath.SkipDir
+		}
+
+		if f.IsDir() {
+			return nil
+		}
+
+		if mediaType := mediaTypeOfPath(path); mediaType != nil {
+			visit(path, f, mediaType)
+		}
+
+		return nil
+	}
+
+	filepath.Walk(*rootDirectory, visitor)
+}
+
+/**
+ * Lists the media files in a single directory
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string          The directory
+ * @return  []os.FileInfo   The media files, without metadata or other files
+**/
+
+func readMediaFiles(dir string) []os.FileInfo {
+
+	files, _ := ioutil.ReadDir(dir)
+	mediaFiles := []os.FileInfo{}
+	for _, f := range files {
+		if !f.IsDir() && mediaTypeOfPath(filepath.Join(dir, f.Name())) != nil {
+			mediaFiles = append(mediaFiles, f)
+		}
+	}
+
+	return mediaFiles
+}
+
+func riffType(header []byte) string {
+
+	if len(header) < 12 || !bytes.HasPrefix(header, []byte("RIFF")) {
+		return ""
+	}
+
+	return string(header[8:12])
+}
+
+// ISO base media files (QuickTime, MP4, HEIC) start with an atom: 4 byte size then the type
+func hasAtom(header []byte, atoms ...string) bool {
+
+	if len(header) < 8 {
+		return false
+	}
+
+	for _, atom := range atoms {
+		if string(header[4:8]) == atom {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The major brand follows the ftyp atom type
+func hasFtypBrand(header []byte, brands ...string) bool {
+
+	if len(header) < 12 || !hasAtom(header, "ftyp") {
+		return false
+	}
+
+	for _, brand := range brands {
+		if string(header[8:12]) == brand {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether the first two packets of an MPEG transport stream start where they should
+func hasSyncBytes(h []byte, offset int, packetSize int) bool {
+
+	return len(h) > offset+packetSize && h[offset] == 0x47 && h[offset+packetSize] == 0x47
+}
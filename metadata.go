@@ -4,10 +4,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 )
 
 type SetMetadata struct {
-	SetId  string
+	SetId string
+
+	// The kind of virtual set, e.g. favorites, or empty for the user's own sets
+	Kind string `json:",omitempty"`
+
+	// The set as it is on Flickr, empty for media not in a set
+	Title          string `json:",omitempty"`
+	Description    string `json:",omitempty"`
+	PrimaryPhotoId string `json:",omitempty"`
+
 	Photos []MediaMetadata
 }
 
@@ -16,6 +27,91 @@ type MediaMetadata struct {
 	PhotoId  string
 	Title    string
 	Filename string
+
+	// Checksum of the file as downloaded, empty for files downloaded before we kept checksums
+	Sha256 string
+	Size   int64
+
+	// Checksum of the file after the metadata was written into it with -embedMetadata, if it was
+	EmbeddedSha256 string `json:",omitempty"`
+	EmbeddedSize   int64  `json:",omitempty"`
+
+	// When the media was uploaded to Flickr, as a unix timestamp
+	DateUploaded int64
+
+	// What was curated on Flickr. DateTaken is as Flickr reports it, e.g.
+	// "2015-06-01 14:30:00" in the camera's time zone, and License is a Flickr license Id.
+	Description string
+	Tags        []string
+	DateTaken   string
+	Latitude    float64
+	Longitude   float64
+	License     string
+
+	// When what was curated last changed on Flickr, as a unix timestamp
+	LastUpdate int64 `json:",omitempty"`
+
+	// Where the media is in the set on Flickr, from 1
+	Position int `json:",omitempty"`
+
+	// Who the media belongs to, for media in virtual sets that isn't the user's own
+	Owner     string `json:",omitempty"`
+	OwnerName string `json:",omitempty"`
+}
+
+/**
+ * Reads a set's metadata file
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string              The set's directory
+ * @return  SetMetadata, bool   The metadata, and whether the file existed
+**/
+
+func loadSetMetadata(dir string) (SetMetadata, bool) {
+
+	metadata := SetMetadata{Photos: []MediaMetadata{}}
+	metadataFile := filepath.Join(dir, setMetadataFileName)
+	if !pathExists(metadataFile) {
+		return metadata, false
+	}
+
+	existingMetadata, _ := ioutil.ReadFile(metadataFile)
+	json.Unmarshal(existingMetadata, &metadata)
+	return metadata, true
+}
+
+/**
+ * Finds every set directory under the root directory, i.e. every
+ * directory with a metadata file.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  []string   The set directories
+**/
+
+func findSetDirectories() []string {
+
+	dirs := []string{}
+	visitor := func(path string, f os.FileInfo, err error) error {
+
+		if err != nil {
+			return nil
+		}
+
+		if isTrashDir(f) {
+			return filepath.SkipDir
+		}
+
+		if !f.IsDir() && f.Name() == setMetadataFileName {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+
+		return nil
+	}
+
+	filepath.Walk(*rootDirectory, visitor)
+	return dirs
 }
 
 /**
@@ -50,7 +146,7 @@ func (sm *SetMetadata) RemoveItemById(id string, metadataFile string) {
 		if photo.PhotoId != id {
 			newListOfMedia = append(newListOfMedia, photo)
 		} else {
-			logMessage(fmt.Sprintf("Removing Id `%v' from the metadata.", id), true)
+			logInfo(fmt.Sprintf("Removing Id `%v' from the metadata.", id), "setId", sm.SetId, "photoId", id)
 		}
 	}
 
@@ -75,7 +171,7 @@ func (sm *SetMetadata) RemoveItemByFilename(fileName string, metadataFile string
 		if photo.Filename != fileName {
 			newListOfMedia = append(newListOfMedia, photo)
 		} else {
-			logMessage(fmt.Sprintf("Removing filename `%v' from the metadata.", fileName), true)
+			logInfo(fmt.Sprintf("Removing filename `%v' from the metadata.", fileName), "setId", sm.SetId, "photoId", photo.PhotoId)
 		}
 	}
 
@@ -102,8 +198,28 @@ func (sm *SetMetadata) AddOrUpdate(p MediaMetadata, metadataFile string) {
 		if photo.PhotoId == p.PhotoId {
 			sm.Photos[index].Title = p.Title
 			sm.Photos[index].Filename = p.Filename
+			if p.Sha256 != "" {
+				sm.Photos[index].Sha256 = p.Sha256
+				sm.Photos[index].Size = p.Size
+				sm.Photos[index].EmbeddedSha256 = p.EmbeddedSha256
+				sm.Photos[index].EmbeddedSize = p.EmbeddedSize
+			}
+			// Only entries made from a Flickr listing know what was curated on Flickr
+			if p.DateUploaded != 0 {
+				sm.Photos[index].DateUploaded = p.DateUploaded
+				sm.Photos[index].Description = p.Description
+				sm.Photos[index].Tags = p.Tags
+				sm.Photos[index].DateTaken = p.DateTaken
+				sm.Photos[index].Latitude = p.Latitude
+				sm.Photos[index].Longitude = p.Longitude
+				sm.Photos[index].License = p.License
+				sm.Photos[index].LastUpdate = p.LastUpdate
+				sm.Photos[index].Position = p.Position
+				sm.Photos[index].Owner = p.Owner
+				sm.Photos[index].OwnerName = p.OwnerName
+			}
 			foundPhoto = true
-			logMessage("Updating existing entry in metadata.", false)
+			logDebug("Updating existing entry in metadata.", "setId", sm.SetId, "photoId", p.PhotoId)
 			break
 		}
 	}
@@ -116,3 +232,26 @@ func (sm *SetMetadata) AddOrUpdate(p MediaMetadata, metadataFile string) {
 
 	sm.Save(metadataFile)
 }
+
+/**
+ * Determines if what was curated on Flickr changed for any media in a set since
+ * it was stored, e.g. a new title or tags. Media stored before we kept the time
+ * of the last update counts as changed.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   map[string]Photo   The set's media on Flickr
+ * @param   SetMetadata        The set's metadata
+ * @return  bool
+**/
+
+func metadataChangedOnFlickr(flickrItems map[string]Photo, sm SetMetadata) bool {
+
+	for _, pm := range sm.Photos {
+		if media, ok := flickrItems[pm.PhotoId]; ok && media.LastUpdate > pm.LastUpdate {
+			return true
+		}
+	}
+
+	return false
+}
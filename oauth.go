@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/base64"
@@ -20,6 +21,7 @@ var oauth_exchange_token_url = "https://www.flickr.com/services/oauth/access_tok
 var oauth_nonce = ""
 var cacheFile = "oauth.json"
 var oauthSecretsFile = "oauth-secrets.json"
+var loadedSecrets *OAuthSecrets
 
 type FlickrOAuth struct {
 	FullName         string
@@ -50,6 +52,9 @@ func (s OAuthSecrets) isValid() bool {
  * Loads the secret OAuth data for this app from a json file. This file
  * should not get committed to source control.
  *
+ * The consumer secret may be stored encrypted, in which case it is decrypted
+ * here. The result is cached since we need the secrets for every request.
+ *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
  * @return  OAuthSecrets
@@ -57,6 +62,10 @@ func (s OAuthSecrets) isValid() bool {
 
 func loadOAuthSecrets() OAuthSecrets {
 
+	if loadedSecrets != nil {
+		return *loadedSecrets
+	}
+
 	s := new(OAuthSecrets)
 	filePath := getUserFilePath(oauthSecretsFile)
 	if pathExists(filePath) {
@@ -64,16 +73,69 @@ func loadOAuthSecrets() OAuthSecrets {
 		if len(fileContents) > 0 {
 			json.Unmarshal(fileContents, &s)
 		} else {
-			logMessage("oauth-secrets.json file was empty", false)
+			logDebug("oauth-secrets.json file was empty")
 		}
 	} else {
-		msg := fmt.Sprintf("No oauth secrets file found at: %v", filePath)
-		logMessage(msg, false)
+		logDebug(fmt.Sprintf("No oauth secrets file found at: %v", filePath))
 	}
 
+	// The config file and environment override the secrets file, and must never
+	// be written into it
+	stored := *s
+	if value := configuredSecret("consumerKey"); value != "" {
+		s.ConsumerKey = value
+	}
+	if value := configuredSecret("consumerSecret"); value != "" {
+		s.Secret = value
+	}
+	if value := configuredSecret("minitokenUrl"); value != "" {
+		s.MinitokenUrl = value
+	}
+
+	if isEncryptedValue(s.Secret) {
+		secret, err := decryptStoredValue(s.Secret)
+		if err != nil {
+			logError(fmt.Sprintf("Could not decrypt the consumer secret in %v: %v", filePath, err))
+			return OAuthSecrets{}
+		}
+		s.Secret = secret
+	}
+
+	if *encryptCredentials && stored.Secret != "" && !isEncryptedValue(stored.Secret) {
+		saveOAuthSecrets(stored)
+	}
+
+	loadedSecrets = s
 	return *s
 }
 
+/**
+ * Saves the OAuth secrets, encrypting the consumer secret
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   OAuthSecrets   The secrets to save
+ * @return  void
+**/
+
+func saveOAuthSecrets(s OAuthSecrets) {
+
+	encrypted, err := encryptStoredValue(s.Secret)
+	if err != nil {
+		logWarn(fmt.Sprintf("Could not encrypt the consumer secret, leaving it as is: %v", err))
+		return
+	}
+	s.Secret = encrypted
+
+	b, _ := json.Marshal(s)
+	err = ioutil.WriteFile(getUserFilePath(oauthSecretsFile), b, perms)
+	if err != nil {
+		panic(err)
+	}
+
+	logInfo("Encrypted the consumer secret in " + oauthSecretsFile)
+}
+
 /**
  * Checks for cached OAuth credentials so we don't need
  * to go through the OAuth process again.
@@ -94,9 +156,102 @@ func checkForExistingOAuthCredentials() FlickrOAuth {
 		}
 	}
 
+	// Credentials supplied by the config file or environment win, and must never
+	// be written into the cache file
+	stored := *oauth
+	if value := configuredSecret("oauthToken"); value != "" {
+		oauth.OAuthToken = value
+	}
+	if value := configuredSecret("oauthTokenSecret"); value != "" {
+		oauth.OAuthTokenSecret = value
+	}
+
+	if isEncryptedValue(oauth.OAuthTokenSecret) {
+		secret, err := decryptStoredValue(oauth.OAuthTokenSecret)
+		if err != nil {
+			// Don't fall through to a new OAuth setup, that would overwrite the
+			// credentials the user can't currently decrypt
+			logError(fmt.Sprintf("Could not decrypt the token secret in %v: %v", filePath, err))
+			panic(err)
+		}
+		oauth.OAuthTokenSecret = secret
+	}
+
+	if *encryptCredentials && stored.OAuthTokenSecret != "" && !isEncryptedValue(stored.OAuthTokenSecret) {
+		saveOAuthCredentials(stored)
+	}
+
 	return *oauth
 }
 
+/**
+ * Saves the OAuth credentials to the cache file, encrypting the token secret
+ * if the user asked for encrypted credentials.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   FlickrOAuth   The credentials to save
+ * @return  void
+**/
+
+func saveOAuthCredentials(oauth FlickrOAuth) {
+
+	if *encryptCredentials {
+		encrypted, err := encryptStoredValue(oauth.OAuthTokenSecret)
+		if err != nil {
+			logError(fmt.Sprintf("Could not encrypt the token secret: %v", err))
+			panic(err)
+		}
+		oauth.OAuthTokenSecret = encrypted
+	}
+
+	b, _ := json.Marshal(oauth)
+
+	filePath := getUserFilePath(cacheFile)
+	err := ioutil.WriteFile(filePath, b, perms)
+	if err != nil {
+		panic(err)
+	}
+}
+
+/**
+ * Encrypts a credential value with the user's passphrase
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string          The plaintext value
+ * @return  string, error
+**/
+
+func encryptStoredValue(value string) (string, error) {
+
+	passphrase, err := getPassphrase(true)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptValue(value, passphrase)
+}
+
+/**
+ * Decrypts a credential value with the user's passphrase
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string          The encrypted value
+ * @return  string, error
+**/
+
+func decryptStoredValue(value string) (string, error) {
+
+	passphrase, err := getPassphrase(false)
+	if err != nil {
+		return "", err
+	}
+
+	return decryptValue(value, passphrase)
+}
+
 /**
  * Does the OAuth handshaking between Flickr and the user, if
  * we didn't find any cached credentials.
@@ -112,10 +267,10 @@ func doOAuthSetup() FlickrOAuth {
 
 	// Get the response from the request token url
 	// and check for errors
-	body, err := makeGetRequest(func() string { return generateRequestTokenUrl() })
+	body, err := makeGetRequest(context.Background(), func() string { return generateRequestTokenUrl() })
 
 	if err != nil {
-		logMessage(fmt.Sprintf("Hmm, something went wrong: %v", err), true)
+		logError(fmt.Sprintf("Hmm, something went wrong: %v", err))
 		return oauthResult
 	}
 
@@ -142,12 +297,12 @@ func doOAuthSetup() FlickrOAuth {
 
 	// Bail if we don't have a token or token secret
 	if oauth_token == "" {
-		logMessage("An error occurred, there was no token: "+string(body), false)
+		logError("An error occurred, there was no token.", "body", string(body))
 		return oauthResult
 	}
 
 	if oauth_token_secret == "" {
-		logMessage("An error occurred, there was no secret: "+string(body), false)
+		logError("An error occurred, there was no secret.", "body", string(body))
 		return oauthResult
 	}
 
@@ -168,7 +323,7 @@ func doOAuthSetup() FlickrOAuth {
 	_, err = fmt.Scanln(&userToken)
 
 	// Get the response and check for errors
-	body, err = makeGetRequest(func() string { return generateExchangeUrl(userToken, oauth_token, oauth_token_secret) })
+	body, err = makeGetRequest(context.Background(), func() string { return generateExchangeUrl(userToken, oauth_token, oauth_token_secret) })
 
 	// Parse the result for the oauth token
 	parts = strings.Split(string(body), "&")
@@ -197,13 +352,7 @@ func doOAuthSetup() FlickrOAuth {
 		}
 	}
 
-	b, err := json.Marshal(oauthResult)
-
-	filePath := getUserFilePath(cacheFile)
-	err = ioutil.WriteFile(filePath, b, perms)
-	if err != nil {
-		panic(err)
-	}
+	saveOAuthCredentials(oauthResult)
 	return oauthResult
 }
 
@@ -438,7 +587,7 @@ func getApiSignature(debugSbs string) string {
 	appFlickrOAuth := checkForExistingOAuthCredentials()
 
 	if appFlickrOAuth.OAuthToken == "" {
-		logMessage("Can't print api signature, no OAuth credentials exist.", true)
+		logError("Can't print api signature, no OAuth credentials exist.")
 		return ""
 	}
 
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+var outputFormat = new(string)
+
+/**
+ * Determines if results should be printed as json instead of prose
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  bool
+**/
+
+func isJsonOutput() bool {
+
+	return *outputFormat == "json"
+}
+
+/**
+ * Prints a value to stdout as indented json
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   interface{}   The value to print
+ * @return  void
+**/
+
+func printJson(v interface{}) {
+
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprintln(os.Stdout, string(b))
+}
+
+/**
+ * Prints a line of a command's results to stdout. Unlike log messages these
+ * aren't affected by -q.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string   The line to print
+ * @return  void
+**/
+
+func printLine(message string) {
+
+	consoleMutex.Lock()
+	defer consoleMutex.Unlock()
+	hideProgress()
+	fmt.Fprintln(os.Stdout, message)
+	showProgress()
+}
+
+/**
+ * Checks the -format flag has a value we understand
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  error
+**/
+
+func validateOutputFormat() error {
+
+	// Commands without a -format flag leave it empty
+	if *outputFormat != "" && *outputFormat != "text" && *outputFormat != "json" {
+		return fmt.Errorf("unknown -format `%v', use text or json", *outputFormat)
+	}
+
+	return nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+)
+
+var dupesSimilar = new(bool)
+var similarHashType = new(string)
+var similarDistance = new(int)
+
+// A group of images that look alike
+type SimilarGroup struct {
+	Files []SimilarFile `json:"files"`
+}
+
+type SimilarFile struct {
+	DuplicateFile
+
+	// Hamming distance from the first file in the group
+	Distance int `json:"distance"`
+}
+
+type imageHash struct {
+	Path string
+	Hash uint64
+}
+
+/**
+ * Finds photos that look alike even though their bytes differ, e.g. re-edited
+ * or re-compressed uploads, by comparing perceptual hashes.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  void
+**/
+
+func findSimilarDupes() {
+
+	hashes := hashImages()
+	groups := clusterSimilarImages(hashes, *similarDistance)
+
+	if isJsonOutput() {
+		printJson(struct {
+			HashType string         `json:"hashType"`
+			Distance int            `json:"distance"`
+			Groups   []SimilarGroup `json:"groups"`
+		}{*similarHashType, *similarDistance, groups})
+		return
+	}
+
+	for _, group := range groups {
+		printLine(fmt.Sprintf("Found %v similar images:", len(group.Files)))
+		for _, file := range group.Files {
+			printLine(fmt.Sprintf("  %v (set `%v', media Id `%v', distance %v)", file.Path, file.Set, file.MediaId, file.Distance))
+		}
+	}
+
+	printLine(fmt.Sprintf("Found %v groups of similar images among %v images, using %v hashes within a distance of %v.", len(groups), len(hashes), *similarHashType, *similarDistance))
+}
+
+/**
+ * Computes the perceptual hash of every image under the root directory we can decode
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  []imageHash
+**/
+
+func hashImages() []imageHash {
+
+	hashes := []imageHash{}
+	walkMediaFiles(func(path string, f os.FileInfo, mediaType *MediaType) {
+
+		if !mediaType.Decodable {
+			return
+		}
+
+		hash, err := perceptualHashFile(path, *similarHashType)
+		if err != nil {
+			logWarn(fmt.Sprintf("Could not hash image `%v': %v", path, err))
+			return
+		}
+
+		hashes = append(hashes, imageHash{Path: path, Hash: hash})
+	})
+
+	return hashes
+}
+
+/**
+ * Groups images whose hashes are within the given Hamming distance of each
+ * other. Grouping is transitive, so a group can hold images further apart
+ * than the distance if there are images in between. Copies of the same media
+ * in several sets are compared once, and a group needs at least two different
+ * media to be reported.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   []imageHash      The image hashes
+ * @param   int              The largest Hamming distance that counts as similar
+ * @return  []SimilarGroup
+**/
+
+func clusterSimilarImages(hashes []imageHash, maxDistance int) []SimilarGroup {
+
+	// Collapse the files by media Id, files we have no Id for stand on their own
+	setMetadata := map[string]SetMetadata{}
+	nodes := [][]SimilarFile{}
+	nodeHashes := []uint64{}
+	nodeByMediaId := map[string]int{}
+	for _, h := range hashes {
+
+		file := SimilarFile{DuplicateFile: describeDuplicateFile(h.Path, setMetadata)}
+		if node, ok := nodeByMediaId[file.MediaId]; ok && file.MediaId != "" {
+			nodes[node] = append(nodes[node], file)
+			continue
+		}
+
+		if file.MediaId != "" {
+			nodeByMediaId[file.MediaId] = len(nodes)
+		}
+		nodes = append(nodes, []SimilarFile{file})
+		nodeHashes = append(nodeHashes, h.Hash)
+	}
+
+	parent := make([]int, len(nodes))
+	for i := range parent {
+		parent[i] = i
+	}
+
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for i := 0; i < len(nodes); i++ {
+		for j := i + 1; j < len(nodes); j++ {
+			if bits.OnesCount64(nodeHashes[i]^nodeHashes[j]) <= maxDistance {
+				parent[find(i)] = find(j)
+			}
+		}
+	}
+
+	members := map[int][]int{}
+	for i := range nodes {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+
+	groups := []SimilarGroup{}
+	for _, group := range members {
+
+		if len(group) < 2 {
+			continue
+		}
+
+		type member struct {
+			file SimilarFile
+			hash uint64
+		}
+		files := []member{}
+		for _, node := range group {
+			for _, file := range nodes[node] {
+				files = append(files, member{file, nodeHashes[node]})
+			}
+		}
+
+		sort.Slice(files, func(i, j int) bool { return files[i].file.Path < files[j].file.Path })
+		similar := SimilarGroup{}
+		for _, m := range files {
+			m.file.Distance = bits.OnesCount64(files[0].hash ^ m.hash)
+			similar.Files = append(similar.Files, m.file)
+		}
+		groups = append(groups, similar)
+	}
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Files[0].Path < groups[j].Files[0].Path })
+	return groups
+}
+
+/**
+ * Computes a 64 bit perceptual hash of an image file
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string          The full path to the image
+ * @param   string          The hash to compute: average, difference or perceptual
+ * @return  uint64, error
+**/
+
+func perceptualHashFile(fullPath string, hashType string) (uint64, error) {
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, err
+	}
+
+	switch hashType {
+	case "average":
+		return averageHash(img), nil
+	case "difference":
+		return differenceHash(img), nil
+	case "perceptual":
+		return perceptualHash(img), nil
+	}
+
+	return 0, fmt.Errorf("unknown hash type `%v'", hashType)
+}
+
+/**
+ * aHash: shrink to 8x8 grayscale, each bit is whether a pixel is brighter than the mean
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   image.Image
+ * @return  uint64
+**/
+
+func averageHash(img image.Image) uint64 {
+
+	pixels := resizeGray(img, 8, 8)
+
+	var mean float64
+	for _, p := range pixels {
+		mean += p
+	}
+	mean /= float64(len(pixels))
+
+	var hash uint64
+	for i, p := range pixels {
+		if p > mean {
+			hash |= 1 << uint(i)
+		}
+	}
+
+	return hash
+}
+
+/**
+ * dHash: shrink to 9x8 grayscale, each bit is whether a pixel is brighter than its right neighbour
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   image.Image
+ * @return  uint64
+**/
+
+func differenceHash(img image.Image) uint64 {
+
+	pixels := resizeGray(img, 9, 8)
+
+	var hash uint64
+	bit := uint(0)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if pixels[y*9+x] > pixels[y*9+x+1] {
+				hash |= 1 << bit
+			}
+			bit++
+		}
+	}
+
+	return hash
+}
+
+/**
+ * pHash: shrink to 32x32 grayscale and take the DCT. Each bit is whether one of
+ * the 8x8 lowest frequencies is above their median. The DC term is left out of
+ * the median since it is just the average brightness.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   image.Image
+ * @return  uint64
+**/
+
+func perceptualHash(img image.Image) uint64 {
+
+	size := 32
+	pixels := resizeGray(img, size, size)
+
+	// Precompute the DCT-II cosine table
+	cosines := make([]float64, size*size)
+	for u := 0; u < size; u++ {
+		for x := 0; x < size; x++ {
+			cosines[u*size+x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / float64(2*size))
+		}
+	}
+
+	// Separable 2D DCT, but we only need the lowest 8x8 frequencies
+	rows := make([]float64, size*8)
+	for y := 0; y < size; y++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for x := 0; x < size; x++ {
+				sum += pixels[y*size+x] * cosines[u*size+x]
+			}
+			rows[y*8+u] = sum
+		}
+	}
+
+	coefficients := make([]float64, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for y := 0; y < size; y++ {
+				sum += rows[y*8+u] * cosines[v*size+y]
+			}
+			coefficients[v*8+u] = sum
+		}
+	}
+
+	sorted := append([]float64{}, coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for i, c := range coefficients {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+
+	return hash
+}
+
+/**
+ * Shrinks an image to the given size in grayscale, averaging the source pixels
+ * that fall in each target pixel.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   image.Image   The image
+ * @param   int           The target width
+ * @param   int           The target height
+ * @return  []float64     The luminance of each target pixel, row by row
+**/
+
+func resizeGray(img image.Image, width int, height int) []float64 {
+
+	if width <= 0 || height <= 0 {
+		return []float64{}
+	}
+
+	bounds := img.Bounds()
+	sums := make([]float64, width*height)
+	counts := make([]float64, width*height)
+
+	// Use the luma plane directly for JPEGs, it is much faster than At()
+	ycbcr, isYCbCr := img.(*image.YCbCr)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+
+		ty := (y - bounds.Min.Y) * height / bounds.Dy()
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+
+			tx := (x - bounds.Min.X) * width / bounds.Dx()
+
+			var luma float64
+			if isYCbCr {
+				luma = float64(ycbcr.Y[ycbcr.YOffset(x, y)])
+			} else {
+				luma = float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			}
+
+			sums[ty*width+tx] += luma
+			counts[ty*width+tx]++
+		}
+	}
+
+	for i := range sums {
+		if counts[i] > 0 {
+			sums[i] /= counts[i]
+			continue
+		}
+
+		// Images smaller than the target leave gaps, fill them from the nearest pixel
+		x := bounds.Min.X + (i%width)*bounds.Dx()/width
+		y := bounds.Min.Y + (i/width)*bounds.Dy()/height
+		sums[i] = float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+	}
+
+	return sums
+}
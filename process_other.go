@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+func processIsRunning(pid int) bool {
+
+	// On Windows finding a process fails if it has exited
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	process.Release()
+	return true
+}
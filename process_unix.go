@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+)
+
+/**
+ * Determines if a process is running
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   int    The process Id
+ * @return  bool
+**/
+
+func processIsRunning(pid int) bool {
+
+	if pid <= 0 {
+		return false
+	}
+
+	// Signal 0 only checks the process exists. EPERM means it does, but belongs to someone else.
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -15,28 +16,97 @@ import (
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
- * @return  void
+ * @param   context.Context   Cancels processing, e.g. when fsync is interrupted
+ * @param   string            The command to record the run as
+ * @return  error
 **/
 
-func processSets() {
+func processSets(ctx context.Context, command string) error {
+
+	appFlickrOAuth, err := ensureOAuthCredentials()
+	if err != nil {
+		return err
+	}
+
+	sets, err := determineSetsToProcess(ctx, appFlickrOAuth)
+	if err != nil {
+		return fmt.Errorf("Could not get the sets from Flickr: %v", err)
+	}
+
+	if !auditOnly {
+		startRun(command)
+	}
+
+	// Favorites, galleries and groups that can't be listed are recorded as errors
+	// and skipped, rather than stopping the user's own sets being backed up
+	if *setId == "" && !*onlyPhotosNotInSet {
+		sets = append(sets, determineVirtualSets(ctx, appFlickrOAuth)...)
+	}
+
+	if !auditOnly {
+		startProgress(sets)
+	}
+
+	setDirectories = indexSetDirectories()
+
+	for _, set := range sets {
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		// In watch mode, sets that haven't changed on Flickr since the last cycle are skipped
+		// without asking Flickr for their media
+		fingerprint := ""
+		if setFingerprints != nil {
+			fingerprint = setFingerprint(ctx, appFlickrOAuth, set)
+			if fingerprint != "" && setFingerprints[set.Id] == fingerprint {
+				logDebug(fmt.Sprintf("Skipping set: `%v'. It hasn't changed since the last sync.", set.Title), "setId", set.Id)
+				currentRun.setSkipped()
+				currentProgress.finishSet()
+				continue
+			}
+		}
+
+		errorsBefore := currentRun.errorCount()
+		if err := processSingleSet(ctx, appFlickrOAuth, set); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			logError(fmt.Sprintf("Could not process set `%v': %v", set.Title, err), "setId", set.Id)
+			currentRun.setFailed(set, err)
+		} else if setFingerprints != nil && currentRun.errorCount() == errorsBefore {
+			setFingerprints[set.Id] = fingerprint
+		}
+		currentProgress.finishSet()
+	}
+
+	stopProgress()
+	return finishRun(ctx.Err() != nil)
+}
+
+/**
+ * Gets the saved OAuth credentials, or runs the OAuth setup if there are none
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  FlickrOAuth, error
+**/
+
+func ensureOAuthCredentials() (FlickrOAuth, error) {
 
 	appFlickrOAuth := checkForExistingOAuthCredentials()
 
 	if appFlickrOAuth.OAuthToken != "" {
-		logMessage(fmt.Sprintf("Using credentials for user: %v", appFlickrOAuth.Username), true)
+		logInfo(fmt.Sprintf("Using credentials for user: %v", appFlickrOAuth.Username))
 	} else {
 		appFlickrOAuth = doOAuthSetup()
 		if appFlickrOAuth.OAuthToken == "" {
-			logMessage("Could not get OAuth token setup.", true)
-			return
+			return appFlickrOAuth, errors.New("Could not get OAuth token setup.")
 		}
 	}
 
-	sets := determineSetsToProcess(appFlickrOAuth)
-
-	for _, set := range sets {
-		processSingleSet(appFlickrOAuth, set)
-	}
+	return appFlickrOAuth, nil
 }
 
 /**
@@ -44,17 +114,21 @@ func processSets() {
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
- * @param   FlickrOAuth   The oauth configuration
- * @return  []Photoset    The list of photosets to process
+ * @param   context.Context      Cancels the requests
+ * @param   FlickrOAuth          The oauth configuration
+ * @return  []Photoset, error    The list of photosets to process
 **/
 
-func determineSetsToProcess(appFlickrOAuth FlickrOAuth) []Photoset {
+func determineSetsToProcess(ctx context.Context, appFlickrOAuth FlickrOAuth) ([]Photoset, error) {
 
 	var sets []Photoset
 	if !*onlyPhotosNotInSet {
 
 		// Get the sets, ordered by created date
-		flickrSets := getSets(appFlickrOAuth)
+		flickrSets, err := getSets(ctx, appFlickrOAuth)
+		if err != nil {
+			return nil, err
+		}
 
 		for _, set := range flickrSets.SetContainer.Sets {
 
@@ -67,10 +141,19 @@ func determineSetsToProcess(appFlickrOAuth FlickrOAuth) []Photoset {
 	}
 
 	if len(sets) == 0 && *setId != "" {
-		set := getSpecificSet(appFlickrOAuth, *setId)
+		set, err := getSpecificSet(ctx, appFlickrOAuth, *setId)
+		if err != nil {
+			return nil, err
+		}
 		sets = append(sets, set.Set)
 	}
 
+	if *mirrorCollections && len(sets) > 0 {
+		if err := assignCollections(ctx, appFlickrOAuth, sets); err != nil {
+			return nil, fmt.Errorf("Could not get the collections: %v", err)
+		}
+	}
+
 	if *setId == "" || *onlyPhotosNotInSet {
 		// Handle photos not in a set if we haven't targeted
 		// a specific set
@@ -80,7 +163,7 @@ func determineSetsToProcess(appFlickrOAuth FlickrOAuth) []Photoset {
 		sets = append(sets, *noSet)
 	}
 
-	return sets
+	return sets, nil
 }
 
 /**
@@ -88,102 +171,82 @@ func determineSetsToProcess(appFlickrOAuth FlickrOAuth) []Photoset {
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
- * @param   FlickrOAuth   Flickr OAuth config
- * @param   Photoset      The set to process
- * @return  void
+ * @param   context.Context   Cancels processing, e.g. when fsync is interrupted
+ * @param   FlickrOAuth       Flickr OAuth config
+ * @param   Photoset          The set to process
+ * @return  error             Why the set couldn't be processed, nothing is changed on disk if so
 **/
 
-func processSingleSet(appFlickrOAuth FlickrOAuth, setToProcess Photoset) {
+func processSingleSet(ctx context.Context, appFlickrOAuth FlickrOAuth, setToProcess Photoset) error {
 
 	// Create the directory for this set with the set's created
 	// date as the prefix so the directories are ordered the same way
 	// flickr orders the sets
 	dir := ensureDirForSet(setToProcess)
+	removePartialFiles(dir)
 
 	// Get all the photos for this set
-	var flickrItems map[string]Photo
-	if len(setToProcess.Id) > 0 {
-		flickrItems = getPhotosForSet(appFlickrOAuth, setToProcess)
-	} else {
-		flickrItems = getPhotosNotInSet(appFlickrOAuth)
+	flickrItems, err := getPhotosForSource(ctx, appFlickrOAuth, setToProcess)
+	if err != nil {
+		return err
 	}
+	flickrItems = filterLicensedMedia(appFlickrOAuth, setToProcess, flickrItems)
+
+	currentProgress.startSet(setToProcess, len(flickrItems))
 
-	// Get all the files on the filesystem, if any exist
-	existingFiles, _ := ioutil.ReadDir(dir)
+	// Get all the media files on the filesystem, if any exist
+	existingFiles := readMediaFiles(dir)
 
 	metadataFile := filepath.Join(dir, setMetadataFileName)
-	var metadata SetMetadata
 
 	// Read the existing metadata, or create a new struct if none is found,
 	// so we can pick up where we left off
-	if pathExists(metadataFile) {
-		existingMetadata, _ := ioutil.ReadFile(metadataFile)
-		json.Unmarshal(existingMetadata, &metadata)
-	} else {
-		metadata = SetMetadata{Photos: []MediaMetadata{}, SetId: setToProcess.Id}
+	metadata, found := loadSetMetadata(dir)
+	if !found {
+		metadata.SetId = setToProcess.Id
 	}
 
-	if *auditOnly == true {
+	if auditOnly == true {
 
-		auditSet(existingFiles, &metadata, flickrItems, setToProcess, metadataFile, dir)
-		return
+		setAudit := auditSet(existingFiles, &metadata, flickrItems, setToProcess, metadataFile, dir)
+		if *auditFix {
+			repairSet(ctx, appFlickrOAuth, &setAudit, &metadata, flickrItems, metadataFile, dir)
+		}
+		auditReport = append(auditReport, setAudit)
+		return nil
 	}
 
+	updateSetDetails(setToProcess, flickrItems, &metadata, metadataFile, dir)
+
 	if *forceProcessing != true {
-		// Skip sets that already have all their files downloaded
-		if len(existingFiles) == (len(flickrItems)+1) && len(flickrItems) == len(metadata.Photos) {
-			logMessage(fmt.Sprintf("Skipping set: `%v'. Found %v existing files.", setToProcess.Title, strconv.Itoa(len(existingFiles))), false)
-			return
+		// Skip sets that already have all their files downloaded, unless the metadata
+		// of some of their media changed on Flickr or their sidecars are missing
+		if len(existingFiles) == len(flickrItems) && len(flickrItems) == len(metadata.Photos) && !metadataChangedOnFlickr(flickrItems, metadata) && !sidecarsMissing(dir, metadata) {
+			logDebug(fmt.Sprintf("Skipping set: `%v'. Found %v existing files.", setToProcess.Title, strconv.Itoa(len(existingFiles))), "setId", setToProcess.Id)
+			writeSetIndexIfWanted(dir, metadata)
+			setDirTimeIfWanted(dir, metadata)
+			currentRun.setSkipped()
+			return nil
 		}
 
 		formatString := "Processing set: `%v'. Found %v existing files on disk, %v files in metadata, and %v files on Flickr."
-		logMessage(fmt.Sprintf(formatString, setToProcess.Title, strconv.Itoa(len(existingFiles)), strconv.Itoa(len(metadata.Photos)), strconv.Itoa(len(flickrItems))), false)
+		logDebug(fmt.Sprintf(formatString, setToProcess.Title, strconv.Itoa(len(existingFiles)), strconv.Itoa(len(metadata.Photos)), strconv.Itoa(len(flickrItems))), "setId", setToProcess.Id)
 	} else {
-		logMessage(fmt.Sprintf("Force processing set: `%v'", setToProcess.Title), false)
+		logDebug(fmt.Sprintf("Force processing set: `%v'", setToProcess.Title), "setId", setToProcess.Id)
 	}
 
-	var fullPath string
-	var fileName string
-	var sourceUrl string
-	var mediaType string
 	for _, media := range flickrItems {
 
-		// Get the photo and video url (if one exists)
-		photoUrl, videoUrl := getOriginalSizeUrl(appFlickrOAuth, media)
-
-		if videoUrl != "" {
-
-			fileName = media.Id + ".mov"
-			sourceUrl = videoUrl
-			mediaType = "video"
-
-		} else if photoUrl != "" {
-
-			fileName = getFileNameFromUrl(photoUrl)
-			sourceUrl = photoUrl
-			mediaType = "photo"
+		downloadMedia(ctx, appFlickrOAuth, media, dir, &metadata, metadataFile)
 
-		} else {
-
-			logMessage(fmt.Sprintf("Could not get original size for media: `%v' (%v). Skipping media for now.", media.Title, media.Id), true)
-			continue
-		}
-
-		fullPath = filepath.Join(dir, fileName)
-
-		// Skip files that exist
-		if pathExists(fullPath) {
-			logMessage(fmt.Sprintf("Media existed at %v. Skipping.", fullPath), false)
-			metadata.AddOrUpdate(MediaMetadata{PhotoId: media.Id, Title: media.Title, Filename: fileName}, metadataFile)
-			continue
+		// The metadata for the files already downloaded is saved, and the download
+		// that was cancelled is cleaned up. Nothing is deleted, since we haven't
+		// looked at every file.
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
 
-		// Save media to disk
-		saveUrlToFile(func() string { return sourceUrl }, fullPath)
-
-		// Add the photos metadata to the list and write the metadata file out
-		metadata.AddOrUpdate(MediaMetadata{PhotoId: media.Id, Title: media.Title, Filename: fileName}, metadataFile)
-		logMessage(fmt.Sprintf("Saved %v `%v' to %v.", mediaType, media.Title, fullPath), false)
+		currentProgress.itemDone()
 	}
 
 	// Look through all the files in the metadata and find the ones that no longer exist in
@@ -192,22 +255,132 @@ func processSingleSet(appFlickrOAuth FlickrOAuth, setToProcess Photoset) {
 	filesToRemove := map[string]string{}
 	for _, pm := range metadata.Photos {
 		if _, ok := flickrItems[pm.PhotoId]; !ok {
-			fullPath = filepath.Join(dir, pm.Filename)
+			fullPath := filepath.Join(dir, pm.Filename)
 			filesToRemove[fullPath] = pm.PhotoId
 		}
 	}
 
 	for photoFilePath, mediaId := range filesToRemove {
 
-		logMessage(fmt.Sprintf("Deleting media Id `%v' at `%v'", mediaId, photoFilePath), true)
+		logInfo(fmt.Sprintf("Deleting media Id `%v' at `%v'", mediaId, photoFilePath), "setId", setToProcess.Id, "photoId", mediaId)
 		deleteFile(photoFilePath)
+		deleteFile(photoFilePath + xmpSidecarSuffix)
 		metadata.RemoveItemById(mediaId, metadataFile)
+		currentRun.addDeletion()
 	}
 
+	writeSetIndexIfWanted(dir, metadata)
+
+	// Last, since adding and removing files changes the directory's time
+	setDirTimeIfWanted(dir, metadata)
+
+	currentRun.setProcessed()
+	return nil
 }
 
 /**
- * Ensures the directory for a set exists on disk
+ * Downloads a single media item into the set's directory, unless it is already
+ * on disk, and records it in the set's metadata.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context   Cancels the download
+ * @param   FlickrOAuth       Flickr OAuth config
+ * @param   Photo             The media to download
+ * @param   string            The set's directory
+ * @param   *SetMetadata      The set's metadata
+ * @param   string            The metadata filename
+ * @return  bool              Whether the media is now on disk
+**/
+
+func downloadMedia(ctx context.Context, appFlickrOAuth FlickrOAuth, media Photo, dir string, metadata *SetMetadata, metadataFile string) bool {
+
+	var fileName string
+	var sourceUrl string
+	var mediaType string
+
+	// Get the photo and video url (if one exists)
+	photoUrl, videoUrl := getOriginalSizeUrl(ctx, appFlickrOAuth, media)
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if videoUrl != "" {
+
+		fileName = media.Id + ".mov"
+		sourceUrl = videoUrl
+		mediaType = "video"
+
+	} else if photoUrl != "" {
+
+		fileName = getFileNameFromUrl(photoUrl)
+		sourceUrl = photoUrl
+		mediaType = "photo"
+
+	} else {
+
+		message := fmt.Sprintf("Could not get original size for media: `%v' (%v). Skipping media for now.", media.Title, media.Id)
+		logWarn(message, "setId", metadata.SetId, "photoId", media.Id)
+		currentRun.addError(metadata.SetId, media.Id, message)
+		return false
+	}
+
+	fileName = sequencedFileName(fileName, media.Position, metadata.SetId)
+	fullPath := filepath.Join(dir, fileName)
+	entry := MediaMetadata{
+		PhotoId:      media.Id,
+		Title:        media.Title,
+		Filename:     fileName,
+		DateUploaded: media.DateUploaded,
+		Description:  media.Description,
+		Tags:         strings.Fields(media.Tags),
+		DateTaken:    media.DateTaken,
+		Latitude:     media.Latitude,
+		Longitude:    media.Longitude,
+		License:      media.License,
+		LastUpdate:   media.LastUpdate,
+		Position:     media.Position,
+		Owner:        media.Owner,
+		OwnerName:    media.OwnerName,
+	}
+
+	// Skip files that exist
+	if pathExists(fullPath) {
+		logDebug(fmt.Sprintf("Media existed at %v. Skipping.", fullPath), "setId", metadata.SetId, "photoId", media.Id)
+		metadata.AddOrUpdate(entry, metadataFile)
+		writeSidecarIfWanted(fullPath, entry, metadata.SetId)
+		setMediaTimeIfWanted(fullPath, entry, metadata.SetId)
+		return true
+	}
+
+	// Save media to disk
+	checksum, err := saveUrlToFile(ctx, func() string { return sourceUrl }, fullPath)
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		currentRun.addError(metadata.SetId, media.Id, fmt.Sprintf("Could not download `%v': %v", media.Title, err))
+		return false
+	}
+
+	currentProgress.addBytes(checksum.Size)
+	currentRun.addDownload(checksum.Size)
+
+	// Add the photos metadata to the list and write the metadata file out
+	entry.Sha256 = checksum.Sha256
+	entry.Size = checksum.Size
+	embedMetadataIfWanted(fullPath, &entry, metadata.SetId)
+	metadata.AddOrUpdate(entry, metadataFile)
+	writeSidecarIfWanted(fullPath, entry, metadata.SetId)
+	setMediaTimeIfWanted(fullPath, entry, metadata.SetId)
+	logDebug(fmt.Sprintf("Saved %v `%v' to %v.", mediaType, media.Title, fullPath), "setId", metadata.SetId, "photoId", media.Id)
+	return true
+}
+
+/**
+ * Ensures the directory for a set exists on disk, inside the directories of
+ * its collections with -collections. Virtual sets have their own top level
+ * directories.
  *
  * @author Ben Reichelt <ben.reichelt@gmail.com>
  *
@@ -218,10 +391,17 @@ func processSingleSet(appFlickrOAuth FlickrOAuth, setToProcess Photoset) {
 func ensureDirForSet(set Photoset) string {
 
 	var dir string
-	if len(set.Id) > 0 {
+	if set.Kind != "" {
+		dir = relocateSetDir(set, virtualSetDir(set))
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			panic(err)
+		}
+	} else if len(set.Id) > 0 {
 		t := time.Unix(int64(set.DateCreated), 0)
 		format := "20060102"
-		dir = filepath.Join(*rootDirectory, fmt.Sprintf("%v %v", t.Format(format), set.CleanTitle()))
+		parts := append([]string{*rootDirectory}, set.Collections...)
+		dir = relocateSetDir(set, filepath.Join(append(parts, fmt.Sprintf("%v %v", t.Format(format), set.CleanTitle()))...))
 		err := os.MkdirAll(dir, 0755)
 		if err != nil {
 			panic(err)
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var progressMode = new(string)
+var progressInterval = new(time.Duration)
+
+// The progress of the sync that is running, if any
+var currentProgress *syncProgress
+
+type syncProgress struct {
+	mutex sync.Mutex
+
+	// Redraw a status line in place, rather than log a line now and then
+	interactive bool
+	shown       bool
+	done        chan bool
+
+	started    time.Time
+	setsTotal  int
+	setsDone   int
+	setTitle   string
+	setItems   int
+	setDone    int
+	itemsTotal int
+	itemsDone  int
+	downloaded int
+	bytes      int64
+}
+
+/**
+ * Checks the -progress flag has a value we understand
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  error
+**/
+
+func validateProgressFlags() error {
+
+	switch *progressMode {
+	case "", "auto", "plain", "off":
+	default:
+		return fmt.Errorf("unknown -progress `%v', use auto, plain or off", *progressMode)
+	}
+
+	if *progressMode != "" && *progressInterval <= 0 {
+		return fmt.Errorf("-progressInterval must be greater than zero")
+	}
+
+	return nil
+}
+
+/**
+ * Starts showing the progress of a sync: a status line that is redrawn in place
+ * when stdout is a terminal, otherwise a log line every -progressInterval.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   []Photoset   The sets that will be processed
+ * @return  void
+**/
+
+func startProgress(sets []Photoset) {
+
+	if *progressMode == "" || *progressMode == "off" || *quiet {
+		return
+	}
+
+	p := &syncProgress{started: time.Now(), setsTotal: len(sets), done: make(chan bool)}
+	p.interactive = *progressMode == "auto" && isTerminal(os.Stdout)
+	for _, set := range sets {
+		p.itemsTotal += set.Photos + set.Videos
+	}
+
+	interval := *progressInterval
+	if p.interactive {
+		interval = time.Second / 2
+	}
+
+	// The watch status reads it from another goroutine, under the console lock
+	consoleMutex.Lock()
+	currentProgress = p
+	consoleMutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+/**
+ * Stops showing progress and clears the status line
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  void
+**/
+
+func stopProgress() {
+
+	p := currentProgress
+	if p == nil {
+		return
+	}
+
+	close(p.done)
+	consoleMutex.Lock()
+	hideProgress()
+	currentProgress = nil
+	consoleMutex.Unlock()
+}
+
+/**
+ * Records that a set has started processing
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   Photoset   The set
+ * @param   int        How many media are in the set on Flickr
+ * @return  void
+**/
+
+func (p *syncProgress) startSet(set Photoset, items int) {
+
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	// Sets that aren't listed with counts, e.g. NO-SET, only get added now
+	if set.Photos+set.Videos == 0 {
+		p.itemsTotal += items
+	}
+	p.setTitle = set.Title
+	p.setItems = items
+	p.setDone = 0
+	p.mutex.Unlock()
+
+	if p.interactive {
+		p.report()
+	}
+}
+
+/**
+ * Records that a set is finished. Media in it that wasn't looked at, e.g.
+ * because the set was skipped, counts as done.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  void
+**/
+
+func (p *syncProgress) finishSet() {
+
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	if p.setDone < p.setItems {
+		p.itemsDone += p.setItems - p.setDone
+	}
+	p.setsDone++
+	p.mutex.Unlock()
+}
+
+/**
+ * Records that a media item in the current set has been looked at
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  void
+**/
+
+func (p *syncProgress) itemDone() {
+
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	p.setDone++
+	p.itemsDone++
+	p.mutex.Unlock()
+}
+
+/**
+ * Records that a media file was downloaded
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   int64   Its size in bytes
+ * @return  void
+**/
+
+func (p *syncProgress) addBytes(bytes int64) {
+
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	p.downloaded++
+	p.bytes += bytes
+	p.mutex.Unlock()
+}
+
+func (p *syncProgress) report() {
+
+	if p.interactive {
+		consoleMutex.Lock()
+		showProgress()
+		consoleMutex.Unlock()
+		return
+	}
+
+	logInfo(p.describe())
+}
+
+/**
+ * Describes the progress so far in one line
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  string
+**/
+
+func (p *syncProgress) describe() string {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	elapsed := time.Since(p.started)
+	rate := float64(p.bytes) / elapsed.Seconds()
+
+	line := fmt.Sprintf("[%v/%v sets]", p.setsDone, p.setsTotal)
+	if p.setTitle != "" {
+		line += fmt.Sprintf(" %v: %v/%v", p.setTitle, p.setDone, p.setItems)
+	}
+	line += fmt.Sprintf(" | %v downloaded (%v) at %v/s", p.downloaded, formatBytes(p.bytes), formatBytes(int64(rate)))
+
+	// Assume the rest goes at the pace of everything so far
+	if p.itemsDone > 0 && p.itemsTotal > p.itemsDone {
+		remaining := time.Duration(float64(elapsed) / float64(p.itemsDone) * float64(p.itemsTotal-p.itemsDone))
+		line += fmt.Sprintf(" | ETA %v", remaining.Round(time.Second))
+	}
+
+	return line
+}
+
+// Clears the status line so something else can be printed. The console mutex must be held.
+func hideProgress() {
+
+	p := currentProgress
+	if p == nil || !p.shown {
+		return
+	}
+
+	fmt.Fprint(os.Stdout, "\r\033[K")
+	p.shown = false
+}
+
+// Draws the status line again. The console mutex must be held.
+func showProgress() {
+
+	p := currentProgress
+	if p == nil || !p.interactive {
+		return
+	}
+
+	line := p.describe()
+	width := 80
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		width = columns
+	}
+	if runes := []rune(line); len(runes) >= width {
+		line = string(runes[:width-1])
+	}
+
+	fmt.Fprint(os.Stdout, "\r\033[K"+line)
+	p.shown = true
+}
+
+/**
+ * Determines if a file is a terminal rather than a pipe or a regular file
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   *os.File
+ * @return  bool
+**/
+
+func isTerminal(f *os.File) bool {
+
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
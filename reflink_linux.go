@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// FICLONE from linux/fs.h
+var ficlone uintptr = 0x40049409
+
+/**
+ * Makes a copy-on-write clone of a file, on filesystems that support it (btrfs, xfs)
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string   The file to clone
+ * @param   string   The path of the new clone
+ * @return  error
+**/
+
+func reflinkFile(source string, destination string) error {
+
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
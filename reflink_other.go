@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func reflinkFile(source string, destination string) error {
+
+	return errors.New("reflinks are only supported on linux")
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var runsDirName = "runs"
+var historyLimit = new(int)
+
+// Older run records are deleted so watch mode doesn't fill the disk
+var maxRunRecords = 1000
+
+// How a run ended
+var runOk = "ok"
+var runFailed = "failed"
+var runInterrupted = "interrupted"
+
+// The record of the sync that is running, if any, and the last one that finished
+var currentRun *RunRecord
+var lastRun *RunRecord
+
+type RunRecord struct {
+	Id            string     `json:"id"`
+	Command       string     `json:"command"`
+	Directory     string     `json:"directory"`
+	Started       time.Time  `json:"started"`
+	Finished      time.Time  `json:"finished"`
+	Duration      string     `json:"duration"`
+	Status        string     `json:"status"`
+	SetsProcessed int        `json:"setsProcessed"`
+	SetsSkipped   int        `json:"setsSkipped"`
+	SetsFailed    int        `json:"setsFailed"`
+	Downloaded    int        `json:"downloaded"`
+	Bytes         int64      `json:"bytes"`
+	Deleted       int        `json:"deleted"`
+	Errors        []RunError `json:"errors"`
+}
+
+type RunError struct {
+	SetId   string `json:"setId"`
+	PhotoId string `json:"photoId,omitempty"`
+	Message string `json:"message"`
+}
+
+/**
+ * Starts recording what a sync does
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string   The command being run
+ * @return  void
+**/
+
+func startRun(command string) {
+
+	started := time.Now()
+	currentRun = &RunRecord{Id: started.Format("20060102-150405.000"), Command: command, Directory: *rootDirectory, Started: started, Errors: []RunError{}}
+}
+
+func (r *RunRecord) setProcessed() {
+
+	if r != nil {
+		r.SetsProcessed++
+	}
+}
+
+func (r *RunRecord) setSkipped() {
+
+	if r != nil {
+		r.SetsSkipped++
+	}
+}
+
+func (r *RunRecord) setFailed(set Photoset, err error) {
+
+	if r != nil {
+		r.SetsFailed++
+		r.addError(set.Id, "", fmt.Sprintf("Could not process set `%v': %v", set.Title, err))
+	}
+}
+
+func (r *RunRecord) addDownload(bytes int64) {
+
+	if r != nil {
+		r.Downloaded++
+		r.Bytes += bytes
+	}
+}
+
+func (r *RunRecord) addDeletion() {
+
+	if r != nil {
+		r.Deleted++
+	}
+}
+
+func (r *RunRecord) errorCount() int {
+
+	if r == nil {
+		return 0
+	}
+
+	return len(r.Errors)
+}
+
+func (r *RunRecord) addError(setId string, photoId string, message string) {
+
+	if r != nil {
+		r.Errors = append(r.Errors, RunError{SetId: setId, PhotoId: photoId, Message: message})
+	}
+}
+
+/**
+ * Prints the summary of the sync that just finished and saves its run record
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   bool    Whether the sync was stopped before it finished
+ * @return  error   Describes the failures, if any sets or media failed
+**/
+
+func finishRun(interrupted bool) error {
+
+	r := currentRun
+	if r == nil {
+		return nil
+	}
+	currentRun = nil
+	lastRun = r
+
+	r.Finished = time.Now()
+	r.Duration = r.Finished.Sub(r.Started).Round(time.Second).String()
+	r.Status = runOk
+	if interrupted {
+		r.Status = runInterrupted
+	} else if r.SetsFailed > 0 || len(r.Errors) > 0 {
+		r.Status = runFailed
+	}
+
+	for _, line := range describeRun(*r, true) {
+		printLine(line)
+	}
+
+	if err := saveRunRecord(*r); err != nil {
+		logWarn(fmt.Sprintf("Could not save the run record: %v", err))
+	}
+
+	if r.Status == runInterrupted {
+		return fmt.Errorf("the sync was interrupted, run `fsync history %v' for what it did", r.Id)
+	}
+
+	if r.Status == runFailed {
+		return fmt.Errorf("%v sets failed and %v errors occurred, run `fsync history %v' for details", r.SetsFailed, len(r.Errors), r.Id)
+	}
+
+	return nil
+}
+
+/**
+ * Describes a run for people
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   RunRecord   The run
+ * @param   bool        Whether to list the errors too
+ * @return  []string    The lines of the description
+**/
+
+func describeRun(r RunRecord, withErrors bool) []string {
+
+	lines := []string{fmt.Sprintf("%v sets processed, %v skipped and %v failed. Downloaded %v files (%v) and deleted %v. %v errors. Took %v.",
+		r.SetsProcessed, r.SetsSkipped, r.SetsFailed, r.Downloaded, formatBytes(r.Bytes), r.Deleted, len(r.Errors), r.Duration)}
+
+	if withErrors {
+		for _, e := range r.Errors {
+			ids := "set `" + e.SetId + "'"
+			if e.PhotoId != "" {
+				ids += ", media Id `" + e.PhotoId + "'"
+			}
+			lines = append(lines, fmt.Sprintf("  %v (%v)", e.Message, ids))
+		}
+	}
+
+	return lines
+}
+
+/**
+ * Saves a run record to ~/.fsync/runs, and deletes the oldest records
+ * past maxRunRecords
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   RunRecord   The run
+ * @return  error
+**/
+
+func saveRunRecord(r RunRecord) error {
+
+	dir := filepath.Join(ensureUserHomeDir(), runsDirName)
+	if err := os.MkdirAll(dir, perms); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, r.Id+".json"), b, 0600); err != nil {
+		return err
+	}
+
+	ids := listRunIds()
+	for len(ids) > maxRunRecords {
+		os.Remove(filepath.Join(dir, ids[0]+".json"))
+		ids = ids[1:]
+	}
+
+	return nil
+}
+
+/**
+ * Lists the Ids of the saved run records, oldest first
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  []string
+**/
+
+func listRunIds() []string {
+
+	files, _ := filepath.Glob(filepath.Join(ensureUserHomeDir(), runsDirName, "*.json"))
+	ids := []string{}
+	for _, f := range files {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(f), ".json"))
+	}
+
+	// The Ids are timestamps, so they sort by time
+	sort.Strings(ids)
+	return ids
+}
+
+/**
+ * Prints the most recent runs, or the details of one run
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string   The Id of the run to show, or an empty string for the list
+ * @return  bool     Whether the run was found
+**/
+
+func printHistory(runId string) bool {
+
+	dir := filepath.Join(ensureUserHomeDir(), runsDirName)
+
+	if runId != "" {
+		r := RunRecord{}
+		if !readJsonFile(filepath.Join(dir, filepath.Base(runId)+".json"), &r) {
+			logError(fmt.Sprintf("There is no run `%v'.", runId))
+			return false
+		}
+
+		if isJsonOutput() {
+			printJson(r)
+			return true
+		}
+
+		printLine(fmt.Sprintf("Run %v: %v of `%v' %v, started %v.", r.Id, r.Command, r.Directory, r.Status, r.Started.Local().Format(time.RFC1123)))
+		for _, line := range describeRun(r, true) {
+			printLine(line)
+		}
+		return true
+	}
+
+	ids := listRunIds()
+	if *historyLimit > 0 && len(ids) > *historyLimit {
+		ids = ids[len(ids)-*historyLimit:]
+	}
+
+	runs := []RunRecord{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		r := RunRecord{}
+		if readJsonFile(filepath.Join(dir, ids[i]+".json"), &r) {
+			runs = append(runs, r)
+		}
+	}
+
+	if isJsonOutput() {
+		printJson(runs)
+		return true
+	}
+
+	if len(runs) == 0 {
+		printLine("No runs have been recorded yet.")
+	}
+
+	for _, r := range runs {
+		printLine(fmt.Sprintf("%v  %-11v  %v", r.Id, r.Status, describeRun(r, false)[0]))
+	}
+
+	return true
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var sequencePrefix = new(bool)
+var setIndexFiles = new(bool)
+
+var setIndexFileName = "README.md"
+
+/**
+ * Prefixes a media file name with the media's position in its set, e.g.
+ * "0007 12345_abcdef_o.jpg", so files sort the way the set is ordered on
+ * Flickr. Flickr's file names never have spaces, so the prefix can always
+ * be told apart from the name. Media not in a set has no order.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string   The file name
+ * @param   int      The media's position in the set, from 1
+ * @param   string   The set Id
+ * @return  string
+**/
+
+func sequencedFileName(fileName string, position int, setId string) string {
+
+	if !*sequencePrefix || position == 0 || setId == "" {
+		return fileName
+	}
+
+	return fmt.Sprintf("%04d %v", position, fileName)
+}
+
+/**
+ * Removes the position prefix added by sequencedFileName, if there is one
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string   The file name
+ * @return  string
+**/
+
+func unsequencedFileName(fileName string) string {
+
+	space := strings.Index(fileName, " ")
+	if space < 1 {
+		return fileName
+	}
+
+	for _, c := range fileName[:space] {
+		if c < '0' || c > '9' {
+			return fileName
+		}
+	}
+
+	return fileName[space+1:]
+}
+
+/**
+ * Gets the name a media file is saved under without asking Flickr for its
+ * sizes: the name in the original's url for photos, and the Id for videos.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   Photo    The media
+ * @return  string   The file name, or an empty string if the listing doesn't say
+**/
+
+func mediaFileName(media Photo) string {
+
+	if media.Media != "photo" {
+		return media.Id + ".mov"
+	}
+
+	if media.OriginalUrl == "" {
+		return ""
+	}
+
+	return getFileNameFromUrl(media.OriginalUrl)
+}
+
+/**
+ * Records a set's kind, title, description, cover photo and the order of its
+ * media in its metadata, and with -sequencePrefix renames files whose position
+ * in the set changed. Nothing is downloaded, so this is done for sets that are
+ * otherwise skipped too.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   Photoset           The set
+ * @param   map[string]Photo   The set's media on Flickr
+ * @param   *SetMetadata       The set's metadata
+ * @param   string             The metadata filename
+ * @param   string             The set's directory
+ * @return  void
+**/
+
+func updateSetDetails(set Photoset, flickrItems map[string]Photo, metadata *SetMetadata, metadataFile string, dir string) {
+
+	changed := false
+	if set.Id != "" && (metadata.Title != set.Title || metadata.Description != set.Description || metadata.PrimaryPhotoId != set.Primary || metadata.Kind != set.Kind) {
+		metadata.Kind = set.Kind
+		metadata.Title = set.Title
+		metadata.Description = set.Description
+		metadata.PrimaryPhotoId = set.Primary
+		changed = true
+	}
+
+	for index, pm := range metadata.Photos {
+
+		media, ok := flickrItems[pm.PhotoId]
+		if !ok {
+			continue
+		}
+
+		if pm.Position != media.Position {
+			metadata.Photos[index].Position = media.Position
+			changed = true
+		}
+
+		// Only files that are this media's original, with or without a prefix, are
+		// renamed. If the original was replaced on Flickr it is downloaded again.
+		fileName := mediaFileName(media)
+		wanted := sequencedFileName(fileName, media.Position, set.Id)
+		if fileName == "" || pm.Filename == wanted || unsequencedFileName(pm.Filename) != fileName {
+			continue
+		}
+
+		oldPath := filepath.Join(dir, pm.Filename)
+		newPath := filepath.Join(dir, wanted)
+		if !pathExists(oldPath) || pathExists(newPath) {
+			continue
+		}
+
+		if err := os.Rename(oldPath, newPath); err != nil {
+			logWarn(fmt.Sprintf("Could not rename `%v' to `%v': %v", oldPath, wanted, err), "setId", set.Id, "photoId", pm.PhotoId)
+			continue
+		}
+		if pathExists(oldPath + xmpSidecarSuffix) {
+			os.Rename(oldPath+xmpSidecarSuffix, newPath+xmpSidecarSuffix)
+		}
+
+		logDebug(fmt.Sprintf("Renamed `%v' to `%v'.", oldPath, wanted), "setId", set.Id, "photoId", pm.PhotoId)
+		metadata.Photos[index].Filename = wanted
+		changed = true
+	}
+
+	if changed {
+		metadata.Save(metadataFile)
+	}
+}
+
+/**
+ * Writes a README.md into a set's directory if -setIndex was given, with the
+ * set's title and description and its media in the order of the set on Flickr.
+ * The file is only rewritten when it changes.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string        The set's directory
+ * @param   SetMetadata   The set's metadata
+ * @return  void
+**/
+
+func writeSetIndexIfWanted(dir string, metadata SetMetadata) {
+
+	if !*setIndexFiles || metadata.SetId == "" {
+		return
+	}
+
+	media := make([]MediaMetadata, len(metadata.Photos))
+	copy(media, metadata.Photos)
+	sort.SliceStable(media, func(i, j int) bool { return media[i].Position < media[j].Position })
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %v\n\n", metadata.Title)
+	if metadata.Description != "" {
+		fmt.Fprintf(&b, "%v\n\n", strings.TrimSpace(metadata.Description))
+	}
+
+	for _, pm := range media {
+		title := pm.Title
+		if title == "" {
+			title = pm.PhotoId
+		}
+
+		line := fmt.Sprintf("1. [%v](<%v>)", title, pm.Filename)
+		if pm.OwnerName != "" {
+			line += " by " + pm.OwnerName
+		}
+		if pm.PhotoId == metadata.PrimaryPhotoId {
+			line += " (cover)"
+		}
+		if pm.DateTaken != "" {
+			line += ", taken " + pm.DateTaken
+		}
+		b.WriteString(line + "\n")
+	}
+
+	indexFile := filepath.Join(dir, setIndexFileName)
+	if existing, err := ioutil.ReadFile(indexFile); err == nil && bytes.Equal(existing, b.Bytes()) {
+		return
+	}
+
+	partialPath := indexFile + partialFileSuffix
+	err := ioutil.WriteFile(partialPath, b.Bytes(), 0644)
+	if err == nil {
+		err = os.Rename(partialPath, indexFile)
+	}
+	if err != nil {
+		logWarn(fmt.Sprintf("Could not write `%v': %v", indexFile, err), "setId", metadata.SetId)
+	}
+}
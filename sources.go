@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var syncFavorites = new(bool)
+var syncGalleries = new(bool)
+var syncGroups = new(string)
+var allowedLicenses = new(string)
+
+// Kinds of virtual sets, which hold media from somewhere other than the user's own sets
+var kindFavorites = "favorites"
+var kindGallery = "gallery"
+var kindGroup = "group"
+
+// The top level directories virtual sets go in
+var favoritesDirName = "FAVORITES"
+var galleriesDirName = "GALLERIES"
+var groupsDirName = "GROUPS"
+
+/**
+ * Checks the -licenses flag only has Flickr license Ids in it
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  error
+**/
+
+func validateLicenseFlag() error {
+
+	for _, license := range strings.Split(*allowedLicenses, ",") {
+		license = strings.TrimSpace(license)
+		if _, ok := flickrLicenses[license]; license != "" && !ok {
+			return fmt.Errorf("unknown license Id `%v' in -licenses, use Flickr license Ids from 0 to 10", license)
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Gets the virtual sets to sync alongside the user's own sets: their
+ * favorites, their galleries and the pools of the groups in -groups. A source
+ * that can't be listed, e.g. a group that went private, is logged, recorded
+ * in the run and left out.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context   Cancels the requests
+ * @param   FlickrOAuth       The oauth configuration
+ * @return  []Photoset
+**/
+
+func determineVirtualSets(ctx context.Context, appFlickrOAuth FlickrOAuth) []Photoset {
+
+	sets := []Photoset{}
+	skipSource := func(id string, message string) {
+		if ctx.Err() != nil {
+			return
+		}
+		logError(message, "setId", id)
+		currentRun.addError(id, "", message)
+	}
+
+	if *syncFavorites {
+		sets = append(sets, Photoset{Id: kindFavorites, Kind: kindFavorites, Title: "Favorites"})
+	}
+
+	if *syncGalleries {
+		galleries, err := getGalleries(ctx, appFlickrOAuth)
+		if err != nil {
+			skipSource("", fmt.Sprintf("Could not get the galleries, skipping them: %v", err))
+		}
+
+		for _, gallery := range galleries {
+			sets = append(sets, Photoset{
+				Id:          gallery.Id,
+				Kind:        kindGallery,
+				Title:       gallery.Title,
+				Description: gallery.Description,
+				Primary:     gallery.Primary,
+				DateCreated: gallery.DateCreated,
+				DateUpdated: gallery.DateUpdated,
+				Photos:      gallery.Photos,
+				Videos:      gallery.Videos,
+			})
+		}
+	}
+
+	for _, groupId := range strings.Split(*syncGroups, ",") {
+		groupId = strings.TrimSpace(groupId)
+		if groupId == "" {
+			continue
+		}
+
+		name, err := getGroupName(ctx, appFlickrOAuth, groupId)
+		if err != nil {
+			skipSource(groupId, fmt.Sprintf("Could not get the group `%v', skipping it: %v", groupId, err))
+			continue
+		}
+		sets = append(sets, Photoset{Id: groupId, Kind: kindGroup, Title: name})
+	}
+
+	return sets
+}
+
+/**
+ * Gets all the media in a set, virtual or not
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context           Cancels the requests
+ * @param   FlickrOAuth               The oauth configuration
+ * @param   Photoset                  The set
+ * @return  map[string]Photo, error   The media, indexed by Flickr Id
+**/
+
+func getPhotosForSource(ctx context.Context, appFlickrOAuth FlickrOAuth, set Photoset) (map[string]Photo, error) {
+
+	var photos map[string]Photo
+	var err error
+
+	switch set.Kind {
+	case kindFavorites:
+		photos, err = getAllPhotos(ctx, appFlickrOAuth, getFavoritesName, set.Id, nil)
+	case kindGallery:
+		photos, err = getAllPhotos(ctx, appFlickrOAuth, getGalleryPhotosName, set.Id, map[string]string{"gallery_id": set.Id})
+	case kindGroup:
+		photos, err = getAllPhotos(ctx, appFlickrOAuth, getGroupPoolPhotosName, set.Id, map[string]string{"group_id": set.Id})
+	default:
+		if set.Id != "" {
+			return getPhotosForSet(ctx, appFlickrOAuth, set)
+		}
+		return getPhotosNotInSet(ctx, appFlickrOAuth)
+	}
+
+	// Favorites and pools are listed newest first, so positions change with every
+	// addition and would rename every file with -sequencePrefix
+	if set.Kind != kindGallery {
+		for id, photo := range photos {
+			photo.Position = 0
+			photos[id] = photo
+		}
+	}
+
+	return photos, err
+}
+
+/**
+ * Leaves out media that belongs to someone else unless its license is in
+ * -licenses, and photos whose owner doesn't allow their original to be
+ * downloaded. Media that was already downloaded is deleted like any other
+ * media that is no longer in the set.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   FlickrOAuth        The oauth configuration
+ * @param   Photoset           The set
+ * @param   map[string]Photo   The set's media
+ * @return  map[string]Photo   The media that may be downloaded
+**/
+
+func filterLicensedMedia(appFlickrOAuth FlickrOAuth, set Photoset, photos map[string]Photo) map[string]Photo {
+
+	if set.Kind == "" {
+		return photos
+	}
+
+	allowed := map[string]bool{}
+	for _, license := range strings.Split(*allowedLicenses, ",") {
+		allowed[strings.TrimSpace(license)] = true
+	}
+
+	filtered := map[string]Photo{}
+	for id, photo := range photos {
+
+		if photo.Owner == "" || photo.Owner == appFlickrOAuth.UserNSID {
+			filtered[id] = photo
+			continue
+		}
+
+		if !allowed[photo.License] {
+			logDebug(fmt.Sprintf("Leaving out `%v' by %v, its license (%v) isn't in -licenses.", photo.Title, photo.OwnerName, licenseName(photo.License)), "setId", set.Id, "photoId", id)
+			continue
+		}
+
+		if photo.Media == "photo" && photo.OriginalUrl == "" {
+			logDebug(fmt.Sprintf("Leaving out `%v' by %v, its owner doesn't allow the original to be downloaded.", photo.Title, photo.OwnerName), "setId", set.Id, "photoId", id)
+			continue
+		}
+
+		filtered[id] = photo
+	}
+
+	return filtered
+}
+
+func licenseName(license string) string {
+
+	if l, ok := flickrLicenses[license]; ok {
+		return l.Name
+	}
+
+	return "license " + license
+}
+
+/**
+ * Gets the directory a virtual set belongs in: FAVORITES, or a directory per
+ * gallery or group under GALLERIES or GROUPS
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   Photoset   The virtual set
+ * @return  string
+**/
+
+func virtualSetDir(set Photoset) string {
+
+	switch set.Kind {
+	case kindFavorites:
+		return filepath.Join(*rootDirectory, favoritesDirName)
+	case kindGallery:
+		t := time.Unix(int64(set.DateCreated), 0)
+		return filepath.Join(*rootDirectory, galleriesDirName, fmt.Sprintf("%v %v", t.Format("20060102"), set.CleanTitle()))
+	}
+
+	return filepath.Join(*rootDirectory, groupsDirName, set.CleanTitle())
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var statsTop = new(int)
+
+type StorageStats struct {
+	Files          int            `json:"files"`
+	Bytes          int64          `json:"bytes"`
+	BySet          []SetStorage   `json:"bySet"`
+	ByType         []TypeStorage  `json:"byType"`
+	ByMonth        []MonthStorage `json:"byMonth"`
+	Largest        []FileStorage  `json:"largest"`
+	DuplicateFiles int            `json:"duplicateFiles"`
+	WastedBytes    int64          `json:"wastedBytes"`
+}
+
+type SetStorage struct {
+	Directory string `json:"directory"`
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+}
+
+type TypeStorage struct {
+	Type  string `json:"type"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Growth of the archive by the month media was uploaded to Flickr, e.g. "2015-06"
+type MonthStorage struct {
+	Month string `json:"month"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+type FileStorage struct {
+	Path  string `json:"path"`
+	Type  string `json:"type"`
+	Bytes int64  `json:"bytes"`
+}
+
+/**
+ * Prints how much disk the archive uses: in total, per set, per media type and
+ * per upload month, the largest files, and the bytes used by media that is in
+ * more than one set.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  void
+**/
+
+func printStorageStats() {
+
+	stats := gatherStorageStats(*statsTop)
+	if isJsonOutput() {
+		printJson(stats)
+		return
+	}
+
+	printLine(fmt.Sprintf("%v media files using %v.", stats.Files, formatBytes(stats.Bytes)))
+
+	printLine("")
+	printLine("By set:")
+	for _, set := range stats.BySet {
+		printLine(fmt.Sprintf("  %10v  %6v files  %v", formatBytes(set.Bytes), set.Files, set.Directory))
+	}
+
+	printLine("")
+	printLine("By type:")
+	for _, t := range stats.ByType {
+		printLine(fmt.Sprintf("  %10v  %6v files  %v", formatBytes(t.Bytes), t.Files, t.Type))
+	}
+
+	printLine("")
+	printLine("By upload month:")
+	var cumulative int64 = 0
+	for _, month := range stats.ByMonth {
+		cumulative += month.Bytes
+		printLine(fmt.Sprintf("  %v  %10v  %6v files  %10v total", month.Month, formatBytes(month.Bytes), month.Files, formatBytes(cumulative)))
+	}
+
+	printLine("")
+	printLine("Largest files:")
+	for _, file := range stats.Largest {
+		printLine(fmt.Sprintf("  %10v  %v", formatBytes(file.Bytes), file.Path))
+	}
+
+	printLine("")
+	printLine(fmt.Sprintf("%v copies of media that is in more than one set use %v. Run `fsync dupes -link' to reclaim it.", stats.DuplicateFiles, formatBytes(stats.WastedBytes)))
+}
+
+/**
+ * Walks the media files under the root directory and totals up their sizes
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   int            How many of the largest files to include
+ * @return  StorageStats
+**/
+
+func gatherStorageStats(top int) StorageStats {
+
+	stats := StorageStats{}
+	bySet := map[string]*SetStorage{}
+	byType := map[string]*TypeStorage{}
+	byMonth := map[string]*MonthStorage{}
+	files := []FileStorage{}
+
+	// Every copy of each Flickr media, to find the ones in more than one set
+	copies := map[string][]string{}
+
+	// The media of each directory, indexed by file name
+	mediaByFilename := map[string]map[string]MediaMetadata{}
+	walkMediaFiles(func(path string, f os.FileInfo, mediaType *MediaType) {
+
+		dir := filepath.Dir(path)
+		media, ok := mediaByFilename[dir]
+		if !ok {
+			metadata, _ := loadSetMetadata(dir)
+			media = map[string]MediaMetadata{}
+			for _, pm := range metadata.Photos {
+				media[pm.Filename] = pm
+			}
+			mediaByFilename[dir] = media
+		}
+
+		// Use the upload date from the metadata, or the file's time if it doesn't have one
+		uploaded := f.ModTime()
+		if pm, ok := media[f.Name()]; ok {
+			if pm.DateUploaded != 0 {
+				uploaded = time.Unix(pm.DateUploaded, 0)
+			}
+			copies[pm.PhotoId] = append(copies[pm.PhotoId], path)
+		}
+
+		set, err := filepath.Rel(*rootDirectory, dir)
+		if err != nil {
+			set = dir
+		}
+
+		if _, ok := bySet[set]; !ok {
+			bySet[set] = &SetStorage{Directory: set}
+		}
+		if _, ok := byType[mediaType.Name]; !ok {
+			byType[mediaType.Name] = &TypeStorage{Type: mediaType.Name}
+		}
+		month := uploaded.Format("2006-01")
+		if _, ok := byMonth[month]; !ok {
+			byMonth[month] = &MonthStorage{Month: month}
+		}
+
+		stats.Files++
+		stats.Bytes += f.Size()
+		bySet[set].Files++
+		bySet[set].Bytes += f.Size()
+		byType[mediaType.Name].Files++
+		byType[mediaType.Name].Bytes += f.Size()
+		byMonth[month].Files++
+		byMonth[month].Bytes += f.Size()
+		files = append(files, FileStorage{Path: path, Type: mediaType.Name, Bytes: f.Size()})
+	})
+
+	stats.BySet = []SetStorage{}
+	for _, set := range bySet {
+		stats.BySet = append(stats.BySet, *set)
+	}
+	sort.Slice(stats.BySet, func(i, j int) bool {
+		if stats.BySet[i].Bytes != stats.BySet[j].Bytes {
+			return stats.BySet[i].Bytes > stats.BySet[j].Bytes
+		}
+		return stats.BySet[i].Directory < stats.BySet[j].Directory
+	})
+
+	stats.ByType = []TypeStorage{}
+	for _, t := range byType {
+		stats.ByType = append(stats.ByType, *t)
+	}
+	sort.Slice(stats.ByType, func(i, j int) bool {
+		if stats.ByType[i].Bytes != stats.ByType[j].Bytes {
+			return stats.ByType[i].Bytes > stats.ByType[j].Bytes
+		}
+		return stats.ByType[i].Type < stats.ByType[j].Type
+	})
+
+	stats.ByMonth = []MonthStorage{}
+	for _, month := range byMonth {
+		stats.ByMonth = append(stats.ByMonth, *month)
+	}
+	sort.Slice(stats.ByMonth, func(i, j int) bool { return stats.ByMonth[i].Month < stats.ByMonth[j].Month })
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Bytes != files[j].Bytes {
+			return files[i].Bytes > files[j].Bytes
+		}
+		return files[i].Path < files[j].Path
+	})
+	if len(files) > top {
+		files = files[:top]
+	}
+	stats.Largest = files
+
+	stats.DuplicateFiles, stats.WastedBytes = measureDuplicateCopies(copies)
+	return stats
+}
+
+/**
+ * Totals the extra copies of media that is in more than one set. Copies that
+ * are hardlinks of each other don't use any more disk, so they aren't counted.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   map[string][]string   The paths of every copy, indexed by Flickr Id
+ * @return  int, int64            The number of extra copies and the bytes they use
+**/
+
+func measureDuplicateCopies(copies map[string][]string) (int, int64) {
+
+	duplicateFiles := 0
+	var wastedBytes int64 = 0
+	for _, paths := range copies {
+
+		if len(paths) < 2 {
+			continue
+		}
+
+		kept := []os.FileInfo{}
+		for _, path := range paths {
+
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+
+			linked := false
+			for _, k := range kept {
+				if os.SameFile(k, info) {
+					linked = true
+					break
+				}
+			}
+
+			if !linked && len(kept) > 0 {
+				duplicateFiles++
+				wastedBytes += info.Size()
+			}
+
+			if !linked {
+				kept = append(kept, info)
+			}
+		}
+	}
+
+	return duplicateFiles, wastedBytes
+}
+
+/**
+ * Formats a number of bytes for people, e.g. 1.5 GB
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   int64    The number of bytes
+ * @return  string
+**/
+
+func formatBytes(bytes int64) string {
+
+	units := []string{"bytes", "KB", "MB", "GB", "TB"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%v %v", bytes, units[unit])
+	}
+
+	return fmt.Sprintf("%.1f %v", value, units[unit])
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var mediaTimes = new(string)
+var dirTimes = new(bool)
+
+// Where file modification times come from
+var mtimeNone = "none"
+var mtimeTaken = "taken"
+var mtimeUpload = "upload"
+
+// Outcomes of fixing a file's time
+var timeFixed = "fixed"
+var timeUnchanged = "unchanged"
+var timeUnknown = "unknown"
+var timeMissing = "missing"
+var timeFailed = "failed"
+
+type TimeFix struct {
+	Directory string `json:"directory"`
+	MediaId   string `json:"mediaId,omitempty"`
+	FileName  string `json:"fileName,omitempty"`
+	Status    string `json:"status"`
+	Time      string `json:"time,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+/**
+ * Checks the -mtime flag has a value we understand
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  error
+**/
+
+func validateTimeFlags() error {
+
+	// Commands without a -mtime flag leave it empty
+	if *mediaTimes != "" && *mediaTimes != mtimeNone && *mediaTimes != mtimeTaken && *mediaTimes != mtimeUpload {
+		return fmt.Errorf("unknown -mtime `%v', use none, taken or upload", *mediaTimes)
+	}
+
+	return nil
+}
+
+/**
+ * Determines the time a media file should have, going by -mtime. Flickr doesn't
+ * know the time zone photos were taken in, so the date taken is read as local
+ * time, which is how file browsers will show it. Media without a date taken
+ * falls back to the upload date.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   MediaMetadata     The media's metadata
+ * @return  time.Time, bool   The time, and whether it is known
+**/
+
+func mediaTime(pm MediaMetadata) (time.Time, bool) {
+
+	if *mediaTimes == mtimeTaken {
+		taken, err := time.ParseInLocation("2006-01-02 15:04:05", pm.DateTaken, time.Local)
+		if err == nil && taken.Year() > 1 {
+			return taken, true
+		}
+	}
+
+	if (*mediaTimes == mtimeTaken || *mediaTimes == mtimeUpload) && pm.DateUploaded != 0 {
+		return time.Unix(pm.DateUploaded, 0), true
+	}
+
+	return time.Time{}, false
+}
+
+/**
+ * Sets a media file's modification time, and its sidecar's, from its Flickr
+ * dates if -mtime was given. Failures are logged, since the media itself is fine.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string          The full path of the media file
+ * @param   MediaMetadata   The media's metadata
+ * @param   string          The set Id, for the log
+ * @return  void
+**/
+
+func setMediaTimeIfWanted(fullPath string, pm MediaMetadata, setId string) {
+
+	t, ok := mediaTime(pm)
+	if !ok {
+		return
+	}
+
+	if err := os.Chtimes(fullPath, t, t); err != nil {
+		logWarn(fmt.Sprintf("Could not set the time of `%v': %v", fullPath, err), "setId", setId, "photoId", pm.PhotoId)
+		return
+	}
+
+	// Sidecars sort next to their media
+	if pathExists(fullPath + xmpSidecarSuffix) {
+		os.Chtimes(fullPath+xmpSidecarSuffix, t, t)
+	}
+}
+
+/**
+ * Sets a set directory's modification time to the time of its newest media if
+ * -dirMtime was given, so directories sort by when their media is from
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string        The set's directory
+ * @param   SetMetadata   The set's metadata
+ * @return  TimeFix       What was done
+**/
+
+func setDirTimeIfWanted(dir string, metadata SetMetadata) TimeFix {
+
+	result := TimeFix{Directory: dir, Status: timeUnknown}
+	if !*dirTimes {
+		return result
+	}
+
+	var newest time.Time
+	for _, pm := range metadata.Photos {
+		if t, ok := mediaTime(pm); ok && t.After(newest) {
+			newest = t
+		}
+	}
+
+	if newest.IsZero() {
+		return result
+	}
+
+	result.Time = newest.Format(time.RFC3339)
+	if info, err := os.Stat(dir); err == nil && info.ModTime().Equal(newest) {
+		result.Status = timeUnchanged
+		return result
+	}
+
+	if err := os.Chtimes(dir, newest, newest); err != nil {
+		logWarn(fmt.Sprintf("Could not set the time of `%v': %v", dir, err), "setId", metadata.SetId)
+		result.Status = timeFailed
+		result.Detail = err.Error()
+		return result
+	}
+
+	result.Status = timeFixed
+	return result
+}
+
+/**
+ * Sets the modification time of every media file under -dir from the Flickr
+ * dates in the set metadata, and with -dirMtime the time of every set
+ * directory. Nothing is downloaded; media synced before dates were stored
+ * gets them on the next sync.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @return  bool   Whether every time that is known could be set
+**/
+
+func fixTimes() bool {
+
+	results := []TimeFix{}
+	dirResults := []TimeFix{}
+	for _, dir := range findSetDirectories() {
+
+		metadata, _ := loadSetMetadata(dir)
+
+		for _, pm := range metadata.Photos {
+
+			result := TimeFix{Directory: dir, MediaId: pm.PhotoId, FileName: pm.Filename, Status: timeUnknown}
+			fullPath := filepath.Join(dir, pm.Filename)
+
+			t, ok := mediaTime(pm)
+			info, err := os.Stat(fullPath)
+			if err != nil {
+				result.Status = timeMissing
+			} else if ok {
+				result.Time = t.Format(time.RFC3339)
+				if info.ModTime().Equal(t) {
+					result.Status = timeUnchanged
+				} else if err := os.Chtimes(fullPath, t, t); err != nil {
+					result.Status = timeFailed
+					result.Detail = err.Error()
+				} else {
+					result.Status = timeFixed
+				}
+
+				// Sidecars sort next to their media
+				if result.Status == timeFixed && pathExists(fullPath+xmpSidecarSuffix) {
+					os.Chtimes(fullPath+xmpSidecarSuffix, t, t)
+				}
+			}
+
+			if result.Status == timeFailed && !isJsonOutput() {
+				printLine(fmt.Sprintf("%v: `%v' (media Id `%v'). %v", result.Status, fullPath, pm.PhotoId, result.Detail))
+			}
+
+			results = append(results, result)
+		}
+
+		if *dirTimes {
+			dirResults = append(dirResults, setDirTimeIfWanted(dir, metadata))
+		}
+	}
+
+	totals := map[string]int{}
+	for _, result := range results {
+		totals[result.Status]++
+	}
+
+	dirTotals := map[string]int{}
+	for _, result := range dirResults {
+		dirTotals[result.Status]++
+	}
+
+	if isJsonOutput() {
+		printJson(struct {
+			Files       []TimeFix      `json:"files"`
+			Directories []TimeFix      `json:"directories,omitempty"`
+			Totals      map[string]int `json:"totals"`
+		}{results, dirResults, totals})
+	} else {
+		printLine(fmt.Sprintf("Checked %v files: %v times set, %v already right, %v without a date, %v missing, %v failed.",
+			len(results), totals[timeFixed], totals[timeUnchanged], totals[timeUnknown], totals[timeMissing], totals[timeFailed]))
+		if *dirTimes {
+			printLine(fmt.Sprintf("Checked %v set directories: %v times set, %v already right, %v failed.",
+				len(dirResults), dirTotals[timeFixed], dirTotals[timeUnchanged], dirTotals[timeFailed]))
+		}
+	}
+
+	return totals[timeFailed] == 0 && dirTotals[timeFailed] == 0
+}
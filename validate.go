@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
+)
+
+var decodeImages = new(bool)
+var downloadAttempts = 3
+
+// Content types Flickr serves media with. Anything else, e.g. an html
+// error page, is not media.
+var mediaContentTypes = []string{"image/", "video/", "application/octet-stream", "binary/octet-stream"}
+
+/**
+ * Checks that a download really is the media we asked for before we save it
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   HttpResponse   The response
+ * @param   string         The file name we're saving to
+ * @return  error          Why the response isn't valid media, or nil
+**/
+
+func validateMediaResponse(response HttpResponse, fileName string) error {
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("unexpected HTTP status %v", response.StatusCode)
+	}
+
+	if response.ContentType != "" {
+		validType := false
+		for _, prefix := range mediaContentTypes {
+			if strings.HasPrefix(strings.ToLower(response.ContentType), prefix) {
+				validType = true
+				break
+			}
+		}
+
+		if !validType {
+			return fmt.Errorf("unexpected Content-Type `%v'", response.ContentType)
+		}
+	}
+
+	if len(response.Body) == 0 {
+		return fmt.Errorf("the response was empty")
+	}
+
+	if response.ContentLength >= 0 && response.ContentLength != int64(len(response.Body)) {
+		return fmt.Errorf("expected %v bytes but got %v, the download was truncated", response.ContentLength, len(response.Body))
+	}
+
+	detected := detectMediaType(response.Body)
+	if detected == nil {
+		return fmt.Errorf("the contents don't look like a photo or video")
+	}
+
+	expected := mediaTypeForFile(fileName)
+	if expected != nil && !mediaTypesCompatible(expected, detected) {
+		return fmt.Errorf("expected %v contents but got %v", expected.Name, detected.Name)
+	}
+
+	if *decodeImages && detected.Decodable {
+		if _, _, err := image.Decode(bytes.NewReader(response.Body)); err != nil {
+			return fmt.Errorf("the %v could not be decoded: %v", detected.Name, err)
+		}
+	}
+
+	return nil
+}
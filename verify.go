@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+)
+
+// Outcomes of verifying a media file
+var verifyOk = "ok"
+var verifyMismatch = "mismatch"
+var verifyMissing = "missing"
+var verifyNoChecksum = "no_checksum"
+var verifyRecorded = "recorded"
+var verifyRepaired = "repaired"
+var verifyRepairFailed = "repair_failed"
+
+var verifyRepair = new(bool)
+var verifyUpdate = new(bool)
+
+type VerifyResult struct {
+	Directory string `json:"directory"`
+	MediaId   string `json:"mediaId"`
+	FileName  string `json:"fileName"`
+	Status    string `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+/**
+ * Rehashes every media file in the metadata and compares it with the checksum
+ * stored when it was downloaded. Corrupted or missing files can be downloaded
+ * from Flickr again.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context   Stops verifying, e.g. when fsync is interrupted
+ * @return  bool              Whether every file checked out
+**/
+
+func verifyFiles(ctx context.Context) bool {
+
+	var appFlickrOAuth FlickrOAuth
+	if *verifyRepair {
+		var err error
+		appFlickrOAuth, err = ensureOAuthCredentials()
+		if err != nil {
+			logError(err.Error())
+			return false
+		}
+	}
+
+	results := []VerifyResult{}
+	for _, dir := range findSetDirectories() {
+
+		metadata, _ := loadSetMetadata(dir)
+		metadataFile := filepath.Join(dir, setMetadataFileName)
+
+		for _, pm := range metadata.Photos {
+
+			if ctx.Err() != nil {
+				return false
+			}
+
+			result := verifyMedia(dir, pm)
+
+			if result.Status == verifyNoChecksum && *verifyUpdate {
+				checksum, err := hashFile(filepath.Join(dir, pm.Filename))
+				if err == nil {
+					pm.Sha256 = checksum.Sha256
+					pm.Size = checksum.Size
+					metadata.AddOrUpdate(pm, metadataFile)
+					result.Status = verifyRecorded
+				}
+			}
+
+			if (result.Status == verifyMismatch || result.Status == verifyMissing) && *verifyRepair {
+				repairMedia(ctx, appFlickrOAuth, dir, pm, &metadata, metadataFile, &result)
+			}
+
+			if result.Status != verifyOk && !isJsonOutput() {
+				message := fmt.Sprintf("%v: `%v' (media Id `%v').", result.Status, filepath.Join(dir, pm.Filename), pm.PhotoId)
+				if result.Detail != "" {
+					message += " " + result.Detail
+				}
+				printLine(message)
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	totals := map[string]int{}
+	for _, result := range results {
+		totals[result.Status]++
+	}
+
+	if isJsonOutput() {
+		printJson(struct {
+			Files  []VerifyResult `json:"files"`
+			Totals map[string]int `json:"totals"`
+		}{results, totals})
+	} else {
+		printLine(fmt.Sprintf("Verified %v files: %v ok, %v corrupted, %v missing, %v without a checksum, %v checksums recorded, %v repaired, %v repairs failed.",
+			len(results), totals[verifyOk], totals[verifyMismatch], totals[verifyMissing], totals[verifyNoChecksum], totals[verifyRecorded], totals[verifyRepaired], totals[verifyRepairFailed]))
+	}
+
+	return totals[verifyMismatch] == 0 && totals[verifyMissing] == 0 && totals[verifyRepairFailed] == 0
+}
+
+/**
+ * Checks a single media file against its stored checksum
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string          The set's directory
+ * @param   MediaMetadata   The media's metadata
+ * @return  VerifyResult
+**/
+
+func verifyMedia(dir string, pm MediaMetadata) VerifyResult {
+
+	result := VerifyResult{Directory: dir, MediaId: pm.PhotoId, FileName: pm.Filename, Status: verifyOk}
+	fullPath := filepath.Join(dir, pm.Filename)
+
+	if !pathExists(fullPath) {
+		result.Status = verifyMissing
+		return result
+	}
+
+	if pm.Sha256 == "" {
+		result.Status = verifyNoChecksum
+		return result
+	}
+
+	checksum, err := hashFile(fullPath)
+	if err != nil {
+		result.Status = verifyMismatch
+		result.Detail = err.Error()
+		return result
+	}
+
+	// Files with the metadata written into them are compared with how they were after that
+	expected := FileChecksum{Sha256: pm.Sha256, Size: pm.Size}
+	if pm.EmbeddedSha256 != "" {
+		expected = FileChecksum{Sha256: pm.EmbeddedSha256, Size: pm.EmbeddedSize}
+	}
+
+	if checksum.Size != expected.Size {
+		result.Status = verifyMismatch
+		result.Detail = fmt.Sprintf("Expected %v bytes, found %v.", expected.Size, checksum.Size)
+	} else if checksum.Sha256 != expected.Sha256 {
+		result.Status = verifyMismatch
+		result.Detail = "The SHA-256 doesn't match."
+	}
+
+	return result
+}
+
+/**
+ * Downloads a corrupted or missing media file from Flickr again
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context   Cancels the download
+ * @param   FlickrOAuth       Flickr OAuth config
+ * @param   string            The set's directory
+ * @param   MediaMetadata     The media's metadata
+ * @param   *SetMetadata      The set's metadata
+ * @param   string            The metadata filename
+ * @param   *VerifyResult     The result to update
+ * @return  void
+**/
+
+func repairMedia(ctx context.Context, appFlickrOAuth FlickrOAuth, dir string, pm MediaMetadata, metadata *SetMetadata, metadataFile string, result *VerifyResult) {
+
+	photoUrl, videoUrl := getSizeUrls(ctx, appFlickrOAuth, pm.PhotoId)
+	sourceUrl := photoUrl
+	if videoUrl != "" {
+		sourceUrl = videoUrl
+	}
+
+	if sourceUrl == "" {
+		result.Status = verifyRepairFailed
+		result.Detail = "Could not get the original url from Flickr."
+		return
+	}
+
+	checksum, err := saveUrlToFile(ctx, func() string { return sourceUrl }, filepath.Join(dir, pm.Filename))
+	if err != nil {
+		result.Status = verifyRepairFailed
+		result.Detail = err.Error()
+		return
+	}
+
+	result.Detail = ""
+	if pm.Sha256 != "" && checksum.Sha256 != pm.Sha256 {
+		result.Detail = "The media on Flickr doesn't match the stored checksum, the checksum was updated."
+	}
+
+	pm.Sha256 = checksum.Sha256
+	pm.Size = checksum.Size
+	pm.EmbeddedSha256 = ""
+	pm.EmbeddedSize = 0
+	embedMetadataIfWanted(filepath.Join(dir, pm.Filename), &pm, metadata.SetId)
+	metadata.AddOrUpdate(pm, metadataFile)
+	setMediaTimeIfWanted(filepath.Join(dir, pm.Filename), pm, metadata.SetId)
+	result.Status = verifyRepaired
+}
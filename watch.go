@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var watchInterval = new(time.Duration)
+var watchFullEvery = new(int)
+var watchStatusAddr = new(string)
+
+var watchStatusFileName = "watch-status.json"
+
+// What each set looked like on Flickr when it was last synced without errors, indexed
+// by set Id. Only used in watch mode, where unchanged sets are skipped.
+var setFingerprints map[string]string
+
+// The state of the watch that is running, if any
+var currentWatch *watchStatus
+
+// What watch mode is doing
+var watchSyncing = "syncing"
+var watchWaiting = "waiting"
+var watchStopped = "stopped"
+
+type WatchStatus struct {
+	State     string     `json:"state"`
+	Pid       int        `json:"pid"`
+	Directory string     `json:"directory"`
+	Interval  string     `json:"interval"`
+	Started   time.Time  `json:"started"`
+	Cycles    int        `json:"cycles"`
+	NextSync  *time.Time `json:"nextSync,omitempty"`
+	Progress  string     `json:"progress,omitempty"`
+	LastRun   *RunRecord `json:"lastRun,omitempty"`
+}
+
+type watchStatus struct {
+	mutex  sync.Mutex
+	status WatchStatus
+}
+
+/**
+ * Syncs every -interval until the context is cancelled, i.e. fsync is interrupted.
+ * Sets that haven't changed on Flickr since the last cycle are skipped, and every
+ * -fullEvery cycles all of them are looked at.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context   Stops watching
+ * @return  bool              Whether watching stopped cleanly
+**/
+
+func watch(ctx context.Context) bool {
+
+	currentWatch = &watchStatus{status: WatchStatus{
+		Pid:       os.Getpid(),
+		Directory: *rootDirectory,
+		Interval:  watchInterval.String(),
+		Started:   time.Now(),
+	}}
+
+	if *watchStatusAddr != "" {
+		listener, err := net.Listen("tcp", *watchStatusAddr)
+		if err != nil {
+			logError(fmt.Sprintf("Could not serve the status on `%v': %v", *watchStatusAddr, err))
+			return false
+		}
+		server := &http.Server{Handler: http.HandlerFunc(serveWatchStatus)}
+		defer server.Close()
+		go server.Serve(listener)
+		logInfo(fmt.Sprintf("Serving the status at http://%v/status", listener.Addr()))
+	}
+
+	logInfo(fmt.Sprintf("Watching, syncing every %v.", *watchInterval))
+
+	for cycle := 0; ; cycle++ {
+
+		// Look at every set now and then, in case something changed that doesn't
+		// change a set's update date or counts, or a file was removed from disk
+		if cycle%*watchFullEvery == 0 {
+			setFingerprints = map[string]string{}
+		}
+
+		currentWatch.update(func(s *WatchStatus) {
+			s.State = watchSyncing
+			s.Cycles++
+			s.NextSync = nil
+		})
+
+		if err := syncCycle(ctx); err != nil && ctx.Err() == nil {
+			logError(err.Error())
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		next := time.Now().Add(*watchInterval)
+		currentWatch.update(func(s *WatchStatus) {
+			s.State = watchWaiting
+			s.NextSync = &next
+			s.LastRun = lastRun
+		})
+		logInfo(fmt.Sprintf("Next sync at %v.", next.Format("2006-01-02 15:04:05")))
+
+		timer := time.NewTimer(*watchInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	currentWatch.update(func(s *WatchStatus) {
+		s.State = watchStopped
+		s.NextSync = nil
+		s.LastRun = lastRun
+	})
+	logInfo("Stopped watching.")
+	return true
+}
+
+/**
+ * Runs one sync. Problems talking to Flickr are reported rather than ending the
+ * watch, so the next cycle can try again.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context   Stops the sync between files when it is done
+ * @return  error
+**/
+
+func syncCycle(ctx context.Context) (err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			stopProgress()
+			currentRun.addError("", "", fmt.Sprint(r))
+			finishRun(false)
+			err = fmt.Errorf("The sync failed: %v", r)
+		}
+	}()
+
+	return processSets(ctx, "watch")
+}
+
+/**
+ * Determines what a set looks like on Flickr without listing its media: when it
+ * was last updated and how much media it has. Media not in a set only has a count.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   context.Context   Cancels the request
+ * @param   FlickrOAuth       The oauth configuration
+ * @param   Photoset          The set
+ * @return  string            The fingerprint, or an empty string if it is unknown
+**/
+
+func setFingerprint(ctx context.Context, appFlickrOAuth FlickrOAuth, set Photoset) string {
+
+	// Favorites and group pools have no update date, so they are always looked at
+	if set.Kind == kindFavorites || set.Kind == kindGroup {
+		return ""
+	}
+
+	// Moving a set to another collection doesn't change its update date
+	if set.Id != "" {
+		return fmt.Sprintf("%v/%v/%v/%v", set.DateUpdated, set.Photos, set.Videos, strings.Join(set.Collections, "/"))
+	}
+
+	total, err := getPhotosNotInSetTotal(ctx, appFlickrOAuth)
+	if err != nil {
+		logWarn(fmt.Sprintf("Could not count the media not in a set: %v", err))
+		return ""
+	}
+
+	return fmt.Sprintf("%v", total)
+}
+
+/**
+ * Changes the watch status and saves it to ~/.fsync/watch-status.json
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   func(*WatchStatus)   Makes the changes
+ * @return  void
+**/
+
+func (w *watchStatus) update(change func(s *WatchStatus)) {
+
+	w.mutex.Lock()
+	change(&w.status)
+	status := w.status
+	w.mutex.Unlock()
+
+	if err := saveWatchStatus(status); err != nil {
+		logWarn(fmt.Sprintf("Could not save the watch status: %v", err))
+	}
+}
+
+func (w *watchStatus) snapshot() WatchStatus {
+
+	w.mutex.Lock()
+	status := w.status
+	w.mutex.Unlock()
+
+	consoleMutex.Lock()
+	p := currentProgress
+	consoleMutex.Unlock()
+
+	if p != nil && status.State == watchSyncing {
+		status.Progress = p.describe()
+	}
+
+	return status
+}
+
+/**
+ * Writes the watch status to a file, replacing the old one in one step so
+ * readers never see half of it
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   WatchStatus   The status
+ * @return  error
+**/
+
+func saveWatchStatus(status WatchStatus) error {
+
+	b, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(ensureUserHomeDir(), watchStatusFileName)
+	if err := ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func serveWatchStatus(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != "/" && r.URL.Path != "/status" {
+		http.NotFound(w, r)
+		return
+	}
+
+	b, err := json.MarshalIndent(currentWatch.snapshot(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
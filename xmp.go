@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var xmpSidecars = new(bool)
+
+// Sidecars are named after the whole media file name, e.g. IMG_1234.jpg.xmp,
+// the way darktable and digiKam look for them
+var xmpSidecarSuffix = ".xmp"
+
+var rdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+type FlickrLicense struct {
+	Name string
+	Url  string
+}
+
+// Flickr's licenses, indexed by their Id
+var flickrLicenses = map[string]FlickrLicense{
+	"0":  {"All Rights Reserved", ""},
+	"1":  {"Attribution-NonCommercial-ShareAlike License", "https://creativecommons.org/licenses/by-nc-sa/2.0/"},
+	"2":  {"Attribution-NonCommercial License", "https://creativecommons.org/licenses/by-nc/2.0/"},
+	"3":  {"Attribution-NonCommercial-NoDerivs License", "https://creativecommons.org/licenses/by-nc-nd/2.0/"},
+	"4":  {"Attribution License", "https://creativecommons.org/licenses/by/2.0/"},
+	"5":  {"Attribution-ShareAlike License", "https://creativecommons.org/licenses/by-sa/2.0/"},
+	"6":  {"Attribution-NoDerivs License", "https://creativecommons.org/licenses/by-nd/2.0/"},
+	"7":  {"No known copyright restrictions", "https://www.flickr.com/commons/usage/"},
+	"8":  {"United States Government Work", "http://www.usa.gov/copyright.shtml"},
+	"9":  {"Public Domain Dedication (CC0)", "https://creativecommons.org/publicdomain/zero/1.0/"},
+	"10": {"Public Domain Mark", "https://creativecommons.org/publicdomain/mark/1.0/"},
+}
+
+/**
+ * Writes the XMP sidecar for a media file if -xmp was given. Failures are
+ * logged, since the media itself is fine.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string          The full path of the media file
+ * @param   MediaMetadata   The media's metadata
+ * @param   string          The set Id, for the log
+ * @return  void
+**/
+
+func writeSidecarIfWanted(fullPath string, pm MediaMetadata, setId string) {
+
+	if !*xmpSidecars {
+		return
+	}
+
+	if err := writeXmpSidecar(fullPath, pm); err != nil {
+		logWarn(fmt.Sprintf("Could not write the XMP sidecar for `%v': %v", fullPath, err), "setId", setId, "photoId", pm.PhotoId)
+	}
+}
+
+/**
+ * Writes an XMP sidecar next to a media file with what was curated on Flickr:
+ * the title, description, tags, date taken, location and license. The sidecar
+ * is only rewritten when it changes, so editors don't see it as modified.
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string          The full path of the media file
+ * @param   MediaMetadata   The media's metadata
+ * @return  error
+**/
+
+func writeXmpSidecar(fullPath string, pm MediaMetadata) error {
+
+	sidecar := fullPath + xmpSidecarSuffix
+	packet := buildXmpPacket(pm)
+
+	if existing, err := ioutil.ReadFile(sidecar); err == nil && bytes.Equal(existing, packet) {
+		return nil
+	}
+
+	partialPath := sidecar + partialFileSuffix
+	if err := ioutil.WriteFile(partialPath, packet, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(partialPath, sidecar)
+}
+
+/**
+ * Determines if -xmp was given and any media in a set doesn't have its sidecar,
+ * e.g. because the set was downloaded before -xmp was used
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   string        The set's directory
+ * @param   SetMetadata   The set's metadata
+ * @return  bool
+**/
+
+func sidecarsMissing(dir string, sm SetMetadata) bool {
+
+	if !*xmpSidecars {
+		return false
+	}
+
+	for _, pm := range sm.Photos {
+		if !pathExists(filepath.Join(dir, pm.Filename) + xmpSidecarSuffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * Builds an XMP packet for a media item, using the Dublin Core, Photoshop,
+ * EXIF and XMP Rights schemas that photo managers read
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   MediaMetadata   The media's metadata
+ * @return  []byte
+**/
+
+func buildXmpPacket(pm MediaMetadata) []byte {
+
+	var b bytes.Buffer
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\" x:xmptk=\"fsync\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"" + rdfNamespace + "\">\n")
+	b.Write(buildXmpDescription(pm))
+	b.WriteString(" </rdf:RDF>\n")
+	b.WriteString("</x:xmpmeta>\n")
+	b.WriteString("<?xpacket end=\"w\"?>\n")
+
+	return b.Bytes()
+}
+
+/**
+ * Builds the rdf:Description with a media item's properties, for a packet of
+ * our own or to add to one that is already in a file
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   MediaMetadata   The media's metadata
+ * @return  []byte
+**/
+
+func buildXmpDescription(pm MediaMetadata) []byte {
+
+	var b bytes.Buffer
+	b.WriteString("  <rdf:Description rdf:about=\"\"\n")
+	b.WriteString("    xmlns:dc=\"http://purl.org/dc/elements/1.1/\"\n")
+	b.WriteString("    xmlns:photoshop=\"http://ns.adobe.com/photoshop/1.0/\"\n")
+	b.WriteString("    xmlns:exif=\"http://ns.adobe.com/exif/1.0/\"\n")
+	b.WriteString("    xmlns:xmpRights=\"http://ns.adobe.com/xap/1.0/rights/\">\n")
+
+	if pm.Title != "" {
+		writeXmpAlt(&b, "dc:title", pm.Title)
+	}
+
+	if pm.Description != "" {
+		writeXmpAlt(&b, "dc:description", pm.Description)
+	}
+
+	if pm.OwnerName != "" {
+		b.WriteString("   <dc:creator>\n    <rdf:Seq>\n")
+		b.WriteString("     <rdf:li>" + xmlEscape(pm.OwnerName) + "</rdf:li>\n")
+		b.WriteString("    </rdf:Seq>\n   </dc:creator>\n")
+	}
+
+	if len(pm.Tags) > 0 {
+		b.WriteString("   <dc:subject>\n    <rdf:Bag>\n")
+		for _, tag := range pm.Tags {
+			b.WriteString("     <rdf:li>" + xmlEscape(tag) + "</rdf:li>\n")
+		}
+		b.WriteString("    </rdf:Bag>\n   </dc:subject>\n")
+	}
+
+	if taken, err := time.Parse("2006-01-02 15:04:05", pm.DateTaken); err == nil {
+		// Flickr doesn't know the time zone, so neither do we
+		date := taken.Format("2006-01-02T15:04:05")
+		b.WriteString("   <photoshop:DateCreated>" + date + "</photoshop:DateCreated>\n")
+		b.WriteString("   <exif:DateTimeOriginal>" + date + "</exif:DateTimeOriginal>\n")
+	}
+
+	if pm.Latitude != 0 || pm.Longitude != 0 {
+		b.WriteString("   <exif:GPSVersionID>2.2.0.0</exif:GPSVersionID>\n")
+		b.WriteString("   <exif:GPSLatitude>" + formatXmpCoordinate(pm.Latitude, "N", "S") + "</exif:GPSLatitude>\n")
+		b.WriteString("   <exif:GPSLongitude>" + formatXmpCoordinate(pm.Longitude, "E", "W") + "</exif:GPSLongitude>\n")
+	}
+
+	if license, ok := flickrLicenses[pm.License]; ok {
+		// Marked means the media is copyrighted, rather than in the public domain
+		marked := "True"
+		if pm.License == "7" || pm.License == "9" || pm.License == "10" {
+			marked = "False"
+		}
+		b.WriteString("   <xmpRights:Marked>" + marked + "</xmpRights:Marked>\n")
+		writeXmpAlt(&b, "xmpRights:UsageTerms", license.Name)
+		if license.Url != "" {
+			b.WriteString("   <xmpRights:WebStatement>" + xmlEscape(license.Url) + "</xmpRights:WebStatement>\n")
+		}
+	}
+
+	b.WriteString("  </rdf:Description>\n")
+
+	return b.Bytes()
+}
+
+func writeXmpAlt(b *bytes.Buffer, property string, value string) {
+
+	b.WriteString("   <" + property + ">\n    <rdf:Alt>\n")
+	b.WriteString("     <rdf:li xml:lang=\"x-default\">" + xmlEscape(value) + "</rdf:li>\n")
+	b.WriteString("    </rdf:Alt>\n   </" + property + ">\n")
+}
+
+/**
+ * Formats a latitude or longitude the way XMP wants it, in degrees and decimal
+ * minutes followed by the direction, e.g. 51,30.0000N
+ *
+ * @author Ben Reichelt <ben.reichelt@gmail.com>
+ *
+ * @param   float64   The coordinate in decimal degrees
+ * @param   string    The direction of positive values, N or E
+ * @param   string    The direction of negative values, S or W
+ * @return  string
+**/
+
+func formatXmpCoordinate(value float64, positive string, negative string) string {
+
+	direction := positive
+	if value < 0 {
+		direction = negative
+		value = -value
+	}
+
+	degrees := math.Floor(value)
+	minutes := (value - degrees) * 60
+	return fmt.Sprintf("%d,%.4f%v", int(degrees), minutes, direction)
+}
+
+func xmlEscape(value string) string {
+
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(value))
+	return b.String()
+}